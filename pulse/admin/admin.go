@@ -0,0 +1,314 @@
+// Package admin provides a client for the RabbitMQ management HTTP API of a
+// Pulse server, for operations that are not available over AMQP, such as
+// listing queues, their bindings and message rates, exchanges, and
+// connections.
+//
+// A Client is typically created from the pulse.Connection used for consuming
+// messages, so that it uses the same credentials and host:
+//
+//  	conn := pulse.NewConnection("", "", "")
+//  	client, err := admin.NewClient(conn)
+//  	...
+//  	queues, err := client.Queues(ctx)
+//
+// Resources are listed in the vhost of the connection. Errors are returned as
+// pulse.PulseError, with Kind pulse.ErrAccessRefused if the credentials are
+// rejected or lack the required permissions, and ErrNotFound if the resource
+// does not exist.
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/taskcluster/pulse-go/pulse"
+	"github.com/taskcluster/pulse-go/pulse/internal/management"
+)
+
+// ErrNotFound is the kind of error returned when the requested resource
+// (e.g. a queue) does not exist (HTTP status code 404)
+var ErrNotFound = errors.New("admin: not found")
+
+// Client is a client for the RabbitMQ management HTTP API.
+type Client struct {
+	// BaseURL is the base URL of the management API, e.g.
+	// "https://pulse.mozilla.org:15671"
+	BaseURL string
+	// VHost is the vhost that resources are listed in
+	VHost    string
+	User     string
+	Password string
+	// HTTPClient is used for making requests. If nil, a client with a 30
+	// second timeout is used.
+	HTTPClient *http.Client
+}
+
+// String implements fmt.Stringer, so that printing a Client with e.g. %v
+// does not leak the password.
+func (c Client) String() string {
+	return fmt.Sprintf("{BaseURL: %s, VHost: %s, User: %s}", c.BaseURL, c.VHost, c.User)
+}
+
+// GoString implements fmt.GoStringer, so that printing a Client with %#v
+// does not leak the password.
+func (c Client) GoString() string {
+	password := ""
+	if c.Password != "" {
+		password = "********"
+	}
+	return fmt.Sprintf("admin.Client{BaseURL:%q, VHost:%q, User:%q, Password:%q}", c.BaseURL, c.VHost, c.User, password)
+}
+
+// LogValue implements slog.LogValuer, so that passing a Client to a
+// structured logger does not leak the password.
+func (c Client) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("base_url", c.BaseURL),
+		slog.String("vhost", c.VHost),
+		slog.String("user", c.User),
+	)
+}
+
+// NewClient returns a client for the management API of the server of conn,
+// which authenticates with the credentials of conn. The management API is
+// located as described by pulse.Connection.ManagementURL.
+func NewClient(conn pulse.Connection) (*Client, error) {
+	baseURL, vhost, err := conn.ManagementAPI()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		BaseURL:  baseURL,
+		VHost:    vhost,
+		User:     conn.User,
+		Password: conn.Password,
+	}, nil
+}
+
+// Rate is the rate of a message statistic, in messages per second
+type Rate struct {
+	Rate float64 `json:"rate"`
+}
+
+// MessageStats holds the message counts of a queue or exchange since it was
+// created, and their current rates.
+type MessageStats struct {
+	Publish           int64 `json:"publish"`
+	PublishDetails    Rate  `json:"publish_details"`
+	PublishIn         int64 `json:"publish_in"`
+	PublishInDetails  Rate  `json:"publish_in_details"`
+	PublishOut        int64 `json:"publish_out"`
+	PublishOutDetails Rate  `json:"publish_out_details"`
+	Deliver           int64 `json:"deliver"`
+	DeliverDetails    Rate  `json:"deliver_details"`
+	DeliverGet        int64 `json:"deliver_get"`
+	DeliverGetDetails Rate  `json:"deliver_get_details"`
+	Ack               int64 `json:"ack"`
+	AckDetails        Rate  `json:"ack_details"`
+	Redeliver         int64 `json:"redeliver"`
+	RedeliverDetails  Rate  `json:"redeliver_details"`
+}
+
+// Queue describes a queue.
+type Queue struct {
+	Name                   string                 `json:"name"`
+	VHost                  string                 `json:"vhost"`
+	Type                   string                 `json:"type"`
+	Durable                bool                   `json:"durable"`
+	AutoDelete             bool                   `json:"auto_delete"`
+	Exclusive              bool                   `json:"exclusive"`
+	Arguments              map[string]interface{} `json:"arguments"`
+	State                  string                 `json:"state"`
+	Consumers              int                    `json:"consumers"`
+	Messages               int                    `json:"messages"`
+	MessagesReady          int                    `json:"messages_ready"`
+	MessagesUnacknowledged int                    `json:"messages_unacknowledged"`
+	MessageBytes           int64                  `json:"message_bytes"`
+	MessageStats           MessageStats           `json:"message_stats"`
+}
+
+// Exchange describes an exchange.
+type Exchange struct {
+	Name         string                 `json:"name"`
+	VHost        string                 `json:"vhost"`
+	Type         string                 `json:"type"`
+	Durable      bool                   `json:"durable"`
+	AutoDelete   bool                   `json:"auto_delete"`
+	Internal     bool                   `json:"internal"`
+	Arguments    map[string]interface{} `json:"arguments"`
+	MessageStats MessageStats           `json:"message_stats"`
+}
+
+// Binding describes a binding of a queue (or exchange) to an exchange.
+type Binding = management.Binding
+
+// Connection describes a client connection to the server.
+type Connection struct {
+	// Name identifies the connection, e.g. for CloseConnection
+	Name     string `json:"name"`
+	User     string `json:"user"`
+	VHost    string `json:"vhost"`
+	State    string `json:"state"`
+	PeerHost string `json:"peer_host"`
+	PeerPort int    `json:"peer_port"`
+	Protocol string `json:"protocol"`
+	Channels int    `json:"channels"`
+	// ConnectedAt is the time the connection was opened, in milliseconds
+	// since the epoch
+	ConnectedAt      int64                  `json:"connected_at"`
+	ClientProperties map[string]interface{} `json:"client_properties"`
+}
+
+// Queues lists the queues of the vhost.
+func (c *Client) Queues(ctx context.Context) ([]Queue, error) {
+	queues := []Queue{}
+	if err := c.request(ctx, "GET", "list queues", &queues, "queues", c.VHost); err != nil {
+		return nil, err
+	}
+	return queues, nil
+}
+
+// Queue returns the queue with the given name.
+func (c *Client) Queue(ctx context.Context, name string) (*Queue, error) {
+	queue := &Queue{}
+	err := c.request(ctx, "GET", "get queue", queue, "queues", c.VHost, name)
+	if err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+// DeleteQueue deletes the queue with the given name, together with any
+// messages in it.
+func (c *Client) DeleteQueue(ctx context.Context, name string) error {
+	return c.request(ctx, "DELETE", "delete queue", nil, "queues", c.VHost, name)
+}
+
+// PurgeQueue removes all messages that are ready for delivery from the queue
+// with the given name.
+func (c *Client) PurgeQueue(ctx context.Context, name string) error {
+	return c.request(ctx, "DELETE", "purge queue", nil, "queues", c.VHost, name, "contents")
+}
+
+// QueueBindings lists the bindings of the queue with the given name,
+// including its binding to the default exchange.
+func (c *Client) QueueBindings(ctx context.Context, name string) ([]Binding, error) {
+	bindings, err := c.management().QueueBindings(ctx, c.VHost, name)
+	if err != nil {
+		return nil, pulseError("list bindings", err)
+	}
+	return bindings, nil
+}
+
+// Bindings lists the bindings of the vhost.
+func (c *Client) Bindings(ctx context.Context) ([]Binding, error) {
+	bindings := []Binding{}
+	if err := c.request(ctx, "GET", "list bindings", &bindings, "bindings", c.VHost); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// Exchanges lists the exchanges of the vhost.
+func (c *Client) Exchanges(ctx context.Context) ([]Exchange, error) {
+	exchanges := []Exchange{}
+	if err := c.request(ctx, "GET", "list exchanges", &exchanges, "exchanges", c.VHost); err != nil {
+		return nil, err
+	}
+	return exchanges, nil
+}
+
+// Exchange returns the exchange with the given name.
+func (c *Client) Exchange(ctx context.Context, name string) (*Exchange, error) {
+	exchange := &Exchange{}
+	err := c.request(ctx, "GET", "get exchange", exchange, "exchanges", c.VHost, name)
+	if err != nil {
+		return nil, err
+	}
+	return exchange, nil
+}
+
+// ExchangeBindings lists the bindings with the exchange of the given name as
+// their source.
+func (c *Client) ExchangeBindings(ctx context.Context, name string) ([]Binding, error) {
+	bindings := []Binding{}
+	if err := c.request(ctx, "GET", "list bindings", &bindings, "exchanges", c.VHost, name, "bindings", "source"); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// Connections lists the client connections of the vhost.
+func (c *Client) Connections(ctx context.Context) ([]Connection, error) {
+	connections := []Connection{}
+	if err := c.request(ctx, "GET", "list connections", &connections, "vhosts", c.VHost, "connections"); err != nil {
+		return nil, err
+	}
+	return connections, nil
+}
+
+// CloseConnection closes the client connection with the given name (see
+// Connection.Name), giving reason to the client.
+func (c *Client) CloseConnection(ctx context.Context, name string, reason string) error {
+	req, err := c.management().NewRequest(ctx, "DELETE", "connections", name)
+	if err != nil {
+		return pulseError("close connection", err)
+	}
+	if reason != "" {
+		req.Header.Set("X-Reason", reason)
+	}
+	return pulseError("close connection", c.management().Do(req, nil))
+}
+
+// management returns the client of the internal package that makes the
+// requests of c
+func (c *Client) management() *management.Client {
+	return &management.Client{
+		BaseURL:    c.BaseURL,
+		User:       c.User,
+		Password:   c.Password,
+		HTTPClient: c.HTTPClient,
+	}
+}
+
+// request makes a request to the management API resource with the given path
+// segments, which are escaped, and decodes the response into result, unless
+// it is nil.
+func (c *Client) request(ctx context.Context, method string, op string, result interface{}, path ...string) error {
+	return pulseError(op, c.management().Request(ctx, method, result, path...))
+}
+
+// pulseError converts an error of the internal management package into a
+// pulse.PulseError for the given operation
+func pulseError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var (
+		urlErr    *management.URLError
+		connErr   *management.ConnectionError
+		statusErr *management.StatusError
+		decodeErr *management.DecodeError
+	)
+	switch {
+	case errors.As(err, &urlErr):
+		return pulse.PulseError{Message: "Invalid management API url " + urlErr.BaseURL, LowerLevelError: urlErr.Err, Op: op}
+	case errors.As(err, &connErr):
+		return pulse.PulseError{Message: "Failed to query management API", LowerLevelError: connErr.Err, Op: op, Kind: pulse.ErrConnection}
+	case errors.As(err, &statusErr):
+		pulseErr := pulse.PulseError{Message: statusErr.Error(), Op: op}
+		switch {
+		case statusErr.AccessRefused():
+			pulseErr.Kind = pulse.ErrAccessRefused
+		case statusErr.NotFound():
+			pulseErr.Kind = ErrNotFound
+		}
+		return pulseErr
+	case errors.As(err, &decodeErr):
+		return pulse.PulseError{Message: "Failed to decode management API response", LowerLevelError: decodeErr.Err, Op: op}
+	}
+	return pulse.PulseError{Message: "Management API request failed", LowerLevelError: err, Op: op}
+}
@@ -0,0 +1,158 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/taskcluster/pulse-go/pulse"
+)
+
+// managementAPI returns a fake management API, serving the given responses
+// by method and escaped path, to clients with the credentials user/secret
+func managementAPI(t *testing.T, responses map[string]string) (*httptest.Server, *[]*http.Request) {
+	requests := []*http.Request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if user, password, _ := r.BasicAuth(); user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "not_authorised", "reason": "Login failed"}`))
+			return
+		}
+		response, ok := responses[r.Method+" "+r.URL.EscapedPath()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "Object Not Found", "reason": "Not Found"}`))
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestNewClient(t *testing.T) {
+	conn := pulse.NewConnection("user", "secret", "amqps://pulse.mozilla.org:5671")
+	client, err := NewClient(conn)
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+	if client.BaseURL != "https://pulse.mozilla.org:15671" || client.VHost != "/" || client.User != "user" || client.Password != "secret" {
+		t.Errorf("Expected client to use the host and credentials of the connection, but got %#v", client)
+	}
+}
+
+func TestClientRedaction(t *testing.T) {
+	client, err := NewClient(pulse.NewConnection("user", "donkey123", "amqps://pulse.mozilla.org:5671"))
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("listing queues", "client", client)
+	for _, output := range []string{
+		fmt.Sprintf("%v", client),
+		fmt.Sprintf("%+v", *client),
+		fmt.Sprintf("%#v", client),
+		buf.String(),
+	} {
+		if strings.Contains(output, "donkey123") || !strings.Contains(output, "user") {
+			t.Errorf("Expected client to be printed without its password, but got %q", output)
+		}
+	}
+}
+
+func TestQueues(t *testing.T) {
+	server, requests := managementAPI(t, map[string]string{
+		"GET /api/queues/%2F":                           `[{"name": "queue/user/a", "vhost": "/", "durable": true, "messages": 3, "messages_ready": 2, "messages_unacknowledged": 1, "consumers": 1, "message_stats": {"publish": 10, "publish_details": {"rate": 0.5}}}]`,
+		"GET /api/queues/%2F/queue%2Fuser%2Fa":          `{"name": "queue/user/a", "type": "quorum"}`,
+		"GET /api/queues/%2F/queue%2Fuser%2Fa/bindings": `[{"source": "", "destination": "queue/user/a", "destination_type": "queue", "routing_key": "queue/user/a"}, {"source": "exchange/a", "destination": "queue/user/a", "destination_type": "queue", "routing_key": "#"}]`,
+		"DELETE /api/queues/%2F/queue%2Fuser%2Fa":       ``,
+	})
+	client, err := NewClient(pulse.Connection{User: "user", Password: "secret", URL: "amqp://localhost:5672", ManagementURL: server.URL})
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+	ctx := context.Background()
+
+	queues, err := client.Queues(ctx)
+	if err != nil {
+		t.Fatalf("Could not list queues: %v", err)
+	}
+	if len(queues) != 1 || queues[0].Name != "queue/user/a" || !queues[0].Durable || queues[0].MessagesReady != 2 || queues[0].MessageStats.PublishDetails.Rate != 0.5 {
+		t.Errorf("Unexpected queues %#v", queues)
+	}
+	queue, err := client.Queue(ctx, "queue/user/a")
+	if err != nil || queue.Type != "quorum" {
+		t.Errorf("Expected quorum queue, but got %#v, %v", queue, err)
+	}
+	bindings, err := client.QueueBindings(ctx, "queue/user/a")
+	if err != nil || len(bindings) != 2 || bindings[1].Source != "exchange/a" || bindings[1].RoutingKey != "#" {
+		t.Errorf("Unexpected bindings %#v, %v", bindings, err)
+	}
+	if err := client.DeleteQueue(ctx, "queue/user/a"); err != nil {
+		t.Errorf("Could not delete queue: %v", err)
+	}
+	if last := (*requests)[len(*requests)-1]; last.Method != "DELETE" {
+		t.Errorf("Expected queue to be deleted, but got %v request", last.Method)
+	}
+
+	_, err = client.Queue(ctx, "queue/user/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, but got %v", err)
+	}
+	client.Password = "wrong"
+	_, err = client.Queues(ctx)
+	var pulseErr pulse.PulseError
+	if !errors.Is(err, pulse.ErrAccessRefused) || !errors.As(err, &pulseErr) || pulseErr.Op != "list queues" {
+		t.Errorf("Expected access to be refused listing queues, but got %#v", err)
+	}
+}
+
+func TestExchangesAndConnections(t *testing.T) {
+	server, requests := managementAPI(t, map[string]string{
+		"GET /api/exchanges/test":                                         `[{"name": "exchange/a", "type": "topic", "durable": true}]`,
+		"GET /api/exchanges/test/exchange%2Fa":                            `{"name": "exchange/a", "type": "topic", "message_stats": {"publish_in": 7}}`,
+		"GET /api/exchanges/test/exchange%2Fa/bindings/source":            `[{"source": "exchange/a", "destination": "queue/user/a", "destination_type": "queue", "routing_key": "#"}]`,
+		"GET /api/bindings/test":                                          `[]`,
+		"GET /api/vhosts/test/connections":                                `[{"name": "127.0.0.1:50000 -> 127.0.0.1:5672", "user": "user", "channels": 2}]`,
+		"DELETE /api/connections/127.0.0.1:50000%20-%3E%20127.0.0.1:5672": ``,
+	})
+	client, err := NewClient(pulse.Connection{User: "user", Password: "secret", URL: "amqp://localhost:5672/test", ManagementURL: server.URL + "/"})
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+	ctx := context.Background()
+
+	exchanges, err := client.Exchanges(ctx)
+	if err != nil || len(exchanges) != 1 || exchanges[0].Type != "topic" {
+		t.Errorf("Unexpected exchanges %#v, %v", exchanges, err)
+	}
+	exchange, err := client.Exchange(ctx, "exchange/a")
+	if err != nil || exchange.MessageStats.PublishIn != 7 {
+		t.Errorf("Unexpected exchange %#v, %v", exchange, err)
+	}
+	bindings, err := client.ExchangeBindings(ctx, "exchange/a")
+	if err != nil || len(bindings) != 1 || bindings[0].Destination != "queue/user/a" {
+		t.Errorf("Unexpected bindings %#v, %v", bindings, err)
+	}
+	if bindings, err := client.Bindings(ctx); err != nil || len(bindings) != 0 {
+		t.Errorf("Expected no bindings, but got %#v, %v", bindings, err)
+	}
+
+	connections, err := client.Connections(ctx)
+	if err != nil || len(connections) != 1 || connections[0].Channels != 2 {
+		t.Fatalf("Unexpected connections %#v, %v", connections, err)
+	}
+	if err := client.CloseConnection(ctx, connections[0].Name, "maintenance"); err != nil {
+		t.Errorf("Could not close connection: %v", err)
+	}
+	if last := (*requests)[len(*requests)-1]; last.Header.Get("X-Reason") != "maintenance" {
+		t.Errorf("Expected reason to be passed, but got %v", last.Header)
+	}
+}
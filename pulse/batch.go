@@ -0,0 +1,171 @@
+package pulse
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DefaultBatchWait is the maximum time ConsumeBatch waits for a batch to fill
+// up, if ConsumeOptions.BatchWait is not set.
+const DefaultBatchWait = time.Second
+
+// ConsumeBatch behaves like ConsumeWithOptions, except that rather than
+// calling the callback once per message, it collects messages into batches,
+// and calls the callback with each batch. A batch is passed to the callback
+// once it contains options.BatchSize messages, or options.BatchWait has
+// elapsed since its first message arrived, whichever happens first.
+//
+// The callback receives the unmarshaled payloads of the messages, and the
+// corresponding deliveries, in the order they arrived. Unless auto
+// acknowledging, the callback should not acknowledge the deliveries itself.
+// Instead, if the callback returns nil, the whole batch is acknowledged with
+// a single ack. If it returns an error, every message of the batch is nacked
+// with requeue=true (and therefore retried, if options.Retry is set). If
+// options.Retry, DeadLetter, MaxInFlight, CircuitBreaker or AdaptivePrefetch
+// is set, the messages of a batch are acknowledged (or nacked) one by one
+// instead, so that each message counts towards them.
+//
+// Since a batch can only fill up if the broker delivers enough messages, the
+// prefetch (and options.MaxInFlight, and the minimum adaptive prefetch, if
+// set) is raised to options.BatchSize if it is lower.
+func (c *Connection) ConsumeBatch(
+	queueName string,
+	callback func([]interface{}, []amqp.Delivery) error,
+	options ConsumeOptions,
+	bindings ...Binding,
+) (
+	PulseQueue,
+	error,
+) {
+	options, err := batchOptions(options)
+	if err != nil {
+		return PulseQueue{}, err
+	}
+	sub, err := c.newSubscription(queueName, options, bindings)
+	if err != nil {
+		return PulseQueue{}, err
+	}
+	go sub.batch(callback, options)
+	return sub.pulseQueue, nil
+}
+
+// batchOptions validates the batch size of options, and returns options
+// with the defaults and raised limits described by ConsumeBatch
+func batchOptions(options ConsumeOptions) (ConsumeOptions, error) {
+	if options.BatchSize < 1 {
+		return options, Error(nil, fmt.Sprintf("Invalid batch size %v - must be at least 1", options.BatchSize))
+	}
+	if options.BatchWait <= 0 {
+		options.BatchWait = DefaultBatchWait
+	}
+	if options.Prefetch > 0 && options.Prefetch < options.BatchSize {
+		options.Prefetch = options.BatchSize
+	}
+	if options.MaxInFlight > 0 && options.MaxInFlight < options.BatchSize {
+		options.MaxInFlight = options.BatchSize
+	}
+	if adaptive := options.AdaptivePrefetch; adaptive != nil && adaptive.Min < options.BatchSize {
+		bounded := *adaptive
+		bounded.Min = options.BatchSize
+		bounded.Max = max(bounded.Max, options.BatchSize)
+		options.AdaptivePrefetch = &bounded
+	}
+	return options, nil
+}
+
+// batch collects the deliveries of the subscription into batches, and passes
+// them to callback, until the queue stops being consumed
+func (sub *subscription) batch(callback func([]interface{}, []amqp.Delivery) error, options ConsumeOptions) {
+	payloads := make([]interface{}, 0, options.BatchSize)
+	deliveries := make([]amqp.Delivery, 0, options.BatchSize)
+	// deadline fires when the current batch has waited long enough
+	var deadline <-chan time.Time
+	flush := func() {
+		deadline = nil
+		if len(deliveries) == 0 {
+			return
+		}
+		err := callback(payloads, deliveries)
+		if !options.AutoAck {
+			sub.settle(deliveries, err)
+		}
+		payloads = make([]interface{}, 0, options.BatchSize)
+		deliveries = make([]amqp.Delivery, 0, options.BatchSize)
+	}
+	for {
+		select {
+		case i, open := <-sub.deliveries:
+			if !open {
+				flush()
+				if err := sub.pulseQueue.stopped(); err != nil {
+					log.Printf("Stopped consuming queue %v: %v", sub.pulseQueue.state.queue, err)
+				}
+				return
+			}
+			i, ok := sub.prepare(i)
+			if !ok {
+				continue
+			}
+			payload, ok := sub.decode(i)
+			if !ok {
+				continue
+			}
+			payloads = append(payloads, payload)
+			deliveries = append(deliveries, i)
+			if len(deliveries) == 1 {
+				deadline = time.After(options.BatchWait)
+			}
+			if len(deliveries) >= options.BatchSize {
+				flush()
+			}
+		case <-deadline:
+			flush()
+		}
+	}
+}
+
+// settle acknowledges a batch of deliveries if err is nil, or otherwise
+// nacks them with requeue=true.
+func (sub *subscription) settle(deliveries []amqp.Delivery, err error) {
+	last := deliveries[len(deliveries)-1]
+	if sub.settlesIndividually() {
+		// settle each delivery, so that the in-flight limit, circuit breaker
+		// and adaptive prefetch count every message, and the retry and dead
+		// letter policies handle each one
+		if err != nil {
+			log.Printf("Batch of %v messages failed, requeuing: %v", len(deliveries), err)
+		}
+		for _, d := range deliveries {
+			var settleErr error
+			if err == nil {
+				settleErr = d.Ack(false)
+			} else {
+				settleErr = d.Nack(false, true)
+			}
+			if settleErr != nil {
+				log.Printf("Not able to settle message: %v", settleErr)
+			}
+		}
+		return
+	}
+	if err == nil {
+		// acknowledges all deliveries up to and including the last one
+		if ackErr := last.Ack(true); ackErr != nil {
+			log.Printf("Not able to ack batch of %v messages: %v", len(deliveries), ackErr)
+		}
+		return
+	}
+	log.Printf("Batch of %v messages failed, requeuing: %v", len(deliveries), err)
+	if nackErr := last.Nack(true, true); nackErr != nil {
+		log.Printf("Not able to nack batch of %v messages: %v", len(deliveries), nackErr)
+	}
+}
+
+// settlesIndividually reports whether the deliveries of the subscription
+// are tracked per message, and so must be settled one by one
+func (sub *subscription) settlesIndividually() bool {
+	return sub.retrier != nil || sub.pulseQueue.deadLetters != nil || sub.inFlight != nil || sub.breaker != nil || sub.tuner != nil
+}
@@ -0,0 +1,124 @@
+package pulse
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestSettleBatch(t *testing.T) {
+	ack := &recordingAcknowledger{}
+	batch := []amqp.Delivery{
+		{Acknowledger: ack, DeliveryTag: 1},
+		{Acknowledger: ack, DeliveryTag: 2},
+		{Acknowledger: ack, DeliveryTag: 3},
+	}
+	sub := &subscription{}
+	sub.settle(batch, nil)
+	if len(ack.acks) != 1 || ack.acks[0] != 3 {
+		t.Errorf("Expected a single ack of the last delivery, but got %#v", ack)
+	}
+
+	ack = &recordingAcknowledger{}
+	for i := range batch {
+		batch[i].Acknowledger = ack
+	}
+	sub.settle(batch, errors.New("database unavailable"))
+	if len(ack.nacks) != 1 || ack.nacks[0] != 3 || !ack.requeued[0] {
+		t.Errorf("Expected a single requeuing nack of the last delivery, but got %#v", ack)
+	}
+}
+
+// batchSubscription returns a subscription whose deliveries are sent on the
+// returned channel, rather than received from the server
+func batchSubscription() (*subscription, chan amqp.Delivery) {
+	deliveries := make(chan amqp.Delivery)
+	closed := make(chan *amqp.Error)
+	close(closed)
+	sub := &subscription{
+		pulseQueue: PulseQueue{
+			closed:   closed,
+			state:    newQueueState(),
+			bindings: newBindingSet(Bind("#", "exchange/test")),
+		},
+		deliveries: deliveries,
+	}
+	return sub, deliveries
+}
+
+func TestBatchFlushes(t *testing.T) {
+	options, err := batchOptions(ConsumeOptions{BatchSize: 3, BatchWait: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Could not create batch options: %v", err)
+	}
+	sub, deliveries := batchSubscription()
+	batches := make(chan []amqp.Delivery, 4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub.batch(func(payloads []interface{}, batch []amqp.Delivery) error {
+			batches <- batch
+			return nil
+		}, options)
+	}()
+	ack := &recordingAcknowledger{}
+	for tag := uint64(1); tag <= 4; tag++ {
+		deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: tag, Exchange: "exchange/test", Body: []byte(`{}`)}
+	}
+	// the first batch is flushed once full, and the second once it has
+	// waited long enough
+	if batch := <-batches; len(batch) != 3 {
+		t.Errorf("Expected full batch of 3 messages, but got %v", len(batch))
+	}
+	start := time.Now()
+	if batch := <-batches; len(batch) != 1 || time.Since(start) < 10*time.Millisecond {
+		t.Errorf("Expected batch of 1 message after waiting, but got %v after %v", len(batch), time.Since(start))
+	}
+	close(deliveries)
+	<-done
+	if len(ack.acks) != 2 || ack.acks[0] != 3 || ack.acks[1] != 4 {
+		t.Errorf("Expected one ack per batch, but got %#v", ack)
+	}
+}
+
+func TestBatchOptions(t *testing.T) {
+	options, err := batchOptions(ConsumeOptions{
+		BatchSize:        10,
+		Prefetch:         2,
+		MaxInFlight:      5,
+		AdaptivePrefetch: &AdaptivePrefetch{Min: 1, Max: 4},
+	})
+	if err != nil {
+		t.Fatalf("Could not create batch options: %v", err)
+	}
+	if options.Prefetch != 10 || options.MaxInFlight != 10 || options.AdaptivePrefetch.Min != 10 || options.AdaptivePrefetch.Max != 10 || options.BatchWait != DefaultBatchWait {
+		t.Errorf("Expected limits to be raised to the batch size, but got %#v", options)
+	}
+	if _, err := batchOptions(ConsumeOptions{}); err == nil {
+		t.Errorf("Expected batch size 0 to be rejected")
+	}
+}
+
+func TestBatchSettlesEachMessage(t *testing.T) {
+	options, _ := batchOptions(ConsumeOptions{BatchSize: 3})
+	sub, deliveries := batchSubscription()
+	sub.tuner = &prefetchTuner{policy: &AdaptivePrefetch{Min: 1, Max: 10}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub.batch(func(payloads []interface{}, batch []amqp.Delivery) error {
+			return nil
+		}, options)
+	}()
+	ack := &recordingAcknowledger{}
+	for tag := uint64(1); tag <= 3; tag++ {
+		deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: tag, Exchange: "exchange/test", Body: []byte(`{}`)}
+	}
+	close(deliveries)
+	<-done
+	if len(ack.acks) != 3 || sub.tuner.settled != 3 {
+		t.Errorf("Expected each message to be acked and measured, but got %#v and %v settled", ack, sub.tuner.settled)
+	}
+}
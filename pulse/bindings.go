@@ -0,0 +1,224 @@
+package pulse
+
+import (
+	"sync"
+)
+
+// bindingSet holds the bindings of a queue, which may change while the
+// queue is being consumed
+type bindingSet struct {
+	mu sync.RWMutex
+	// all holds the bindings in the order they were added
+	all []bindingEntry
+	// keep a map from exchange name to exchange objects, so later we can
+	// unmarshal pulse messages into correct object from the exchange name
+	// and routing key in the amqp.Delivery object to get back to Binding, and
+	// thus to Binding.NewPayloadObject(). The bindings of each exchange are in
+	// the same order as in all.
+	lookup map[string][]Binding
+	// retired holds the bindings of exchanges whose last binding has been
+	// removed, so that messages from them that are still in flight can be
+	// decoded
+	retired map[string][]Binding
+	// nextID is the id of the next binding added
+	nextID uint64
+}
+
+// bindingEntry is a binding of a bindingSet, together with an id that
+// identifies it even if the set holds other bindings with the same exchange
+// and routing key
+type bindingEntry struct {
+	id      uint64
+	binding Binding
+}
+
+func newBindingSet(bindings ...Binding) *bindingSet {
+	s := &bindingSet{
+		lookup:  make(map[string][]Binding, len(bindings)),
+		retired: map[string][]Binding{},
+	}
+	for _, binding := range bindings {
+		s.add(binding)
+	}
+	return s
+}
+
+// forExchange returns the bindings for the given exchange, or if it has no
+// bindings any more, the bindings it had before they were removed
+func (s *bindingSet) forExchange(exchangeName string) ([]Binding, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if bindings, ok := s.lookup[exchangeName]; ok {
+		return bindings, true
+	}
+	bindings, ok := s.retired[exchangeName]
+	return bindings, ok
+}
+
+// add adds binding, returning the id of its entry (see removeEntry)
+func (s *bindingSet) add(binding Binding) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.all = append(s.all, bindingEntry{id: id, binding: binding})
+	s.lookup[binding.ExchangeName()] = append(s.lookup[binding.ExchangeName()], binding)
+	delete(s.retired, binding.ExchangeName())
+	return id
+}
+
+// remove removes the first binding with the same exchange and routing key as
+// binding, returning it, and whether another binding with the same exchange
+// and routing key remains.
+func (s *bindingSet) remove(binding Binding) (removed Binding, duplicated bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, entry := range s.all {
+		if sameBinding(entry.binding, binding) {
+			return s.removeAt(i)
+		}
+	}
+	return nil, false
+}
+
+// removeEntry removes the binding with the given id, returned by add, and
+// leaves any other binding with the same exchange and routing key alone
+func (s *bindingSet) removeEntry(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, entry := range s.all {
+		if entry.id == id {
+			s.removeAt(i)
+			return
+		}
+	}
+}
+
+// removeAt removes the i-th binding, returning it, and whether another
+// binding with the same exchange and routing key remains. The caller must
+// hold s.mu.
+func (s *bindingSet) removeAt(i int) (removed Binding, duplicated bool) {
+	removed = s.all[i].binding
+	exchangeName := removed.ExchangeName()
+	// the position of the binding among the bindings of its exchange
+	position := 0
+	for _, entry := range s.all[:i] {
+		if entry.binding.ExchangeName() == exchangeName {
+			position++
+		}
+	}
+	s.all = append(s.all[:i:i], s.all[i+1:]...)
+	bindings := s.lookup[exchangeName]
+	remaining := append(bindings[:position:position], bindings[position+1:]...)
+	for _, b := range remaining {
+		if sameBinding(b, removed) {
+			duplicated = true
+		}
+	}
+	if len(remaining) == 0 {
+		s.retired[exchangeName] = bindings
+		delete(s.lookup, exchangeName)
+	} else {
+		s.lookup[exchangeName] = remaining
+	}
+	return removed, duplicated
+}
+
+// bindings returns a copy of the bindings, in the order they were added
+func (s *bindingSet) bindings() []Binding {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bindings := make([]Binding, len(s.all))
+	for i, entry := range s.all {
+		bindings[i] = entry.binding
+	}
+	return bindings
+}
+
+// sameBinding reports whether a and b bind the same exchange with the same
+// routing key
+func sameBinding(a, b Binding) bool {
+	return a.ExchangeName() == b.ExchangeName() && a.RoutingKey() == b.RoutingKey()
+}
+
+// Bindings returns the bindings of the queue, in the order they were added.
+func (pq *PulseQueue) Bindings() []Binding {
+	if pq.bindings == nil {
+		return nil
+	}
+	return pq.bindings.bindings()
+}
+
+// AddBinding binds the queue to a further exchange and routing key while it
+// is being consumed. Messages matching binding are decoded as described by
+// binding, as for the bindings passed to Consume.
+func (pq *PulseQueue) AddBinding(binding Binding) error {
+	if pq.ch == nil {
+		return Error(nil, "Queue is not being consumed")
+	}
+	// server errors close the channel they occur on, so use a separate
+	// channel, in order that a missing exchange does not stop consumption
+	ch, err := pq.state.conn.Channel()
+	if err != nil {
+		return pq.opError("open channel", ErrConnection, err, "Failed to open a channel")
+	}
+	defer ch.Close()
+	err = ch.ExchangeDeclarePassive(
+		binding.ExchangeName(), // name
+		"topic",                // type
+		false,                  // durable
+		false,                  // auto-deleted
+		false,                  // internal
+		false,                  // no-wait
+		nil,                    // arguments
+	)
+	if err != nil {
+		return pq.opError("declare exchange", nil, err, "Failed to passively declare exchange "+binding.ExchangeName())
+	}
+	// messages can arrive as soon as the queue is bound, so the binding must
+	// be known beforehand
+	id := pq.bindings.add(binding)
+	err = ch.QueueBind(
+		pq.state.queue,         // queue name
+		binding.RoutingKey(),   // routing key
+		binding.ExchangeName(), // exchange
+		false,
+		nil)
+	if err != nil {
+		pq.bindings.removeEntry(id)
+		return pq.opError("bind queue", nil, err, "Failed to bind a queue")
+	}
+	return nil
+}
+
+// RemoveBinding unbinds the queue from the exchange and routing key of
+// binding while it is being consumed. Messages from the exchange that are
+// already in the queue are still delivered.
+func (pq *PulseQueue) RemoveBinding(binding Binding) error {
+	if pq.ch == nil {
+		return Error(nil, "Queue is not being consumed")
+	}
+	removed, duplicated := pq.bindings.remove(binding)
+	if removed == nil {
+		return Error(nil, "Queue has no binding to exchange "+binding.ExchangeName()+" with routing key "+binding.RoutingKey())
+	}
+	if duplicated {
+		return nil
+	}
+	ch, err := pq.state.conn.Channel()
+	if err != nil {
+		pq.bindings.add(removed)
+		return pq.opError("open channel", ErrConnection, err, "Failed to open a channel")
+	}
+	defer ch.Close()
+	err = ch.QueueUnbind(
+		pq.state.queue,         // queue name
+		binding.RoutingKey(),   // routing key
+		binding.ExchangeName(), // exchange
+		nil)
+	if err != nil {
+		pq.bindings.add(removed)
+		return pq.opError("unbind queue", nil, err, "Failed to unbind queue")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package pulse
+
+import (
+	"testing"
+)
+
+func TestBindingSet(t *testing.T) {
+	defined := Bind("*.*.gaia.#", "exchange/taskcluster-queue/v1/task-defined")
+	completed := Bind("#", "exchange/taskcluster-queue/v1/task-completed")
+	s := newBindingSet(defined, completed)
+
+	typed := &typedBinding{rk: "#", en: "exchange/taskcluster-queue/v1/task-defined"}
+	s.add(typed)
+	if bindings, _ := s.forExchange("exchange/taskcluster-queue/v1/task-defined"); len(bindings) != 2 || bindings[1] != typed {
+		t.Errorf("Expected added binding to be used for decoding, but got %v", bindings)
+	}
+	if all := s.bindings(); len(all) != 3 || all[2] != typed {
+		t.Errorf("Expected bindings in the order they were added, but got %v", all)
+	}
+
+	// removing a duplicate keeps the other
+	s.add(Bind("#", "exchange/taskcluster-queue/v1/task-completed"))
+	if removed, duplicated := s.remove(Bind("#", "exchange/taskcluster-queue/v1/task-completed")); removed == nil || !duplicated {
+		t.Errorf("Expected duplicate binding to be removed, and the other kept")
+	}
+	if removed, duplicated := s.remove(completed); removed == nil || duplicated {
+		t.Errorf("Expected last binding to exchange to be removed")
+	}
+	if removed, _ := s.remove(completed); removed != nil {
+		t.Errorf("Expected no binding to be removed, but removed %v", removed)
+	}
+	// messages still in flight from the exchange can be decoded
+	if bindings, ok := s.forExchange("exchange/taskcluster-queue/v1/task-completed"); !ok || len(bindings) != 1 {
+		t.Errorf("Expected bindings of removed exchange to be retired, but got %v", bindings)
+	}
+	if _, ok := s.forExchange("exchange/unknown"); ok {
+		t.Errorf("Expected no bindings for unknown exchange")
+	}
+	if all := s.bindings(); len(all) != 2 || all[0] != defined || all[1] != typed {
+		t.Errorf("Unexpected bindings after removal %v", all)
+	}
+}
+
+func TestRemoveBindingEntry(t *testing.T) {
+	first := Bind("#", "exchange/test")
+	s := newBindingSet(first, Bind("a.#", "exchange/other"))
+	duplicate := &typedBinding{rk: "#", en: "exchange/test"}
+	id := s.add(duplicate)
+	// e.g. after failing to bind the queue for the duplicate
+	s.removeEntry(id)
+	if bindings, _ := s.forExchange("exchange/test"); len(bindings) != 1 || bindings[0] != first {
+		t.Errorf("Expected only the added binding to be removed, but got %v", bindings)
+	}
+	if all := s.bindings(); len(all) != 2 || all[0] != first {
+		t.Errorf("Unexpected bindings after removal %v", all)
+	}
+	s.removeEntry(id)
+	if all := s.bindings(); len(all) != 2 {
+		t.Errorf("Expected removing an entry twice to have no effect, but got %v", all)
+	}
+}
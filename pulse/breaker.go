@@ -0,0 +1,204 @@
+package pulse
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DefaultProbeInterval is how long a circuit breaker keeps a queue paused
+// before probing whether processing succeeds again, if
+// CircuitBreakerPolicy.ProbeInterval is not set.
+const DefaultProbeInterval = 30 * time.Second
+
+// CircuitBreakerPolicy describes when to stop consuming from a queue because
+// messages keep failing, e.g. because a downstream service is unavailable.
+//
+// A message fails if it is nacked or rejected, and succeeds if it is
+// acknowledged. After FailureThreshold consecutive failures, the circuit
+// breaker opens: the queue is paused (see PulseQueue.Pause), so that failing
+// messages are not redelivered in a tight loop. After ProbeInterval, the
+// circuit breaker is half-open: the queue is resumed with a prefetch of 1,
+// so that a single message probes whether processing succeeds again. If it
+// does, the circuit breaker closes, and the queue is consumed as normal,
+// otherwise the queue is paused again for another ProbeInterval. A queue
+// paused by calling PulseQueue.Pause is not resumed by the circuit breaker.
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failures that opens
+	// the circuit breaker
+	FailureThreshold int
+	// ProbeInterval is how long the queue is paused before being probed,
+	// and defaults to DefaultProbeInterval
+	ProbeInterval time.Duration
+	// OnStateChange, if set, is called whenever the circuit breaker opens
+	// (open is true) or closes (open is false)
+	OnStateChange func(open bool)
+}
+
+// breakerState is the state of a circuit breaker
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker pauses a queue when its messages keep failing
+type circuitBreaker struct {
+	policy *CircuitBreakerPolicy
+	// pause pauses the queue, and resume resumes it, either with a prefetch
+	// of 1 to probe it, or with its normal prefetch, replacing the consumer
+	// that probed it
+	pause  func() error
+	resume func(probe bool) error
+	// done is closed when the queue stops being consumed
+	done <-chan struct{}
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+}
+
+func newCircuitBreaker(policy *CircuitBreakerPolicy, pq PulseQueue) *circuitBreaker {
+	return &circuitBreaker{
+		policy: policy,
+		pause: func() error {
+			pq.state.mu.Lock()
+			defer pq.state.mu.Unlock()
+			return pq.pause()
+		},
+		resume: func(probe bool) error {
+			pq.state.mu.Lock()
+			defer pq.state.mu.Unlock()
+			if pq.state.userPaused {
+				// leave the queue paused until the user resumes it
+				return nil
+			}
+			if probe {
+				return pq.resume(1)
+			}
+			if err := pq.pause(); err != nil {
+				return err
+			}
+			return pq.resume(pq.state.prefetch)
+		},
+		done: pq.state.ctx.Done(),
+	}
+}
+
+// wrap records the outcome of the delivery when it is settled
+func (b *circuitBreaker) wrap(d amqp.Delivery) amqp.Delivery {
+	d.Acknowledger = &breakerAcknowledger{
+		Acknowledger: d.Acknowledger,
+		breaker:      b,
+	}
+	return d
+}
+
+// record updates the state of the circuit breaker with the outcome of a
+// message. Pausing and resuming the queue happens in the background, since
+// deliveries may be settled while the queue is dispatching messages.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.policy.FailureThreshold {
+			b.state = breakerOpen
+			log.Printf("Circuit breaker opened after %v consecutive failures - pausing queue", b.failures)
+			go b.open(true)
+		}
+	case breakerHalfOpen:
+		if success {
+			b.state = breakerClosed
+			b.failures = 0
+			log.Print("Circuit breaker closed - resuming queue")
+			go b.close()
+			return
+		}
+		b.state = breakerOpen
+		go b.open(false)
+	case breakerOpen:
+		// outcomes of messages delivered before the queue was paused
+	}
+}
+
+// tripped reports whether the circuit breaker is open or half-open
+func (b *circuitBreaker) tripped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// open pauses the queue, and schedules a probe
+func (b *circuitBreaker) open(notify bool) {
+	if notify && b.policy.OnStateChange != nil {
+		b.policy.OnStateChange(true)
+	}
+	if err := b.pause(); err != nil {
+		// probe anyway, so that the circuit breaker does not stay open
+		// forever
+		log.Printf("Circuit breaker not able to pause queue: %v", err)
+	}
+	interval := b.policy.ProbeInterval
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+	time.AfterFunc(interval, b.probe)
+}
+
+// probe resumes the queue with a prefetch of 1, so that a single message
+// determines whether the circuit breaker closes
+func (b *circuitBreaker) probe() {
+	select {
+	case <-b.done:
+		return
+	default:
+	}
+	b.mu.Lock()
+	b.state = breakerHalfOpen
+	b.mu.Unlock()
+	if err := b.resume(true); err != nil {
+		log.Printf("Circuit breaker not able to resume queue: %v", err)
+	}
+}
+
+// close restores the normal prefetch of the queue, which requires a new
+// consumer
+func (b *circuitBreaker) close() {
+	if b.policy.OnStateChange != nil {
+		b.policy.OnStateChange(false)
+	}
+	if err := b.resume(false); err != nil {
+		log.Printf("Circuit breaker not able to resume queue: %v", err)
+	}
+}
+
+// breakerAcknowledger records the outcome of deliveries in a circuit breaker
+type breakerAcknowledger struct {
+	amqp.Acknowledger
+	breaker *circuitBreaker
+}
+
+func (a *breakerAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.breaker.record(true)
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *breakerAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.breaker.record(false)
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *breakerAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.breaker.record(false)
+	return a.Acknowledger.Reject(tag, requeue)
+}
@@ -0,0 +1,135 @@
+package pulse
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	changed := make(chan bool, 2)
+	b := &circuitBreaker{
+		policy: &CircuitBreakerPolicy{
+			FailureThreshold: 3,
+			ProbeInterval:    10 * time.Millisecond,
+			OnStateChange:    func(open bool) { changed <- open },
+		},
+		pause: func() error {
+			record("pause")
+			return nil
+		},
+		resume: func(probe bool) error {
+			record(map[bool]string{true: "probe", false: "resume"}[probe])
+			return nil
+		},
+		done: make(chan struct{}),
+	}
+	state := func() breakerState {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.state
+	}
+
+	// a success resets the count of consecutive failures
+	b.record(false)
+	b.record(false)
+	b.record(true)
+	b.record(false)
+	b.record(false)
+	if state() != breakerClosed {
+		t.Fatalf("Expected circuit breaker to stay closed")
+	}
+	b.record(false)
+	if open := <-changed; !open || state() != breakerOpen {
+		t.Fatalf("Expected circuit breaker to open after 3 consecutive failures")
+	}
+
+	// wait for the probe, which fails
+	for state() != breakerHalfOpen {
+		time.Sleep(time.Millisecond)
+	}
+	b.record(false)
+	for state() != breakerHalfOpen {
+		time.Sleep(time.Millisecond)
+	}
+	b.record(true)
+	if open := <-changed; open {
+		t.Fatalf("Expected circuit breaker to close after successful probe")
+	}
+	// restoring the prefetch happens in the background
+	expected := []string{"pause", "probe", "pause", "probe", "resume"}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= len(expected) {
+			break
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Expected %v but got %v", expected, events)
+		}
+	}
+}
+
+func TestCircuitBreakerProbesAfterFailedPause(t *testing.T) {
+	b := &circuitBreaker{
+		policy: &CircuitBreakerPolicy{FailureThreshold: 1, ProbeInterval: time.Millisecond},
+		pause:  func() error { return errors.New("channel closed") },
+		resume: func(probe bool) error { return nil },
+		done:   make(chan struct{}),
+	}
+	b.record(false)
+	halfOpen := func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.state == breakerHalfOpen
+	}
+	for deadline := time.Now().Add(time.Second); !halfOpen(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected circuit breaker to probe although pausing failed")
+		}
+	}
+	b.record(true)
+	if b.tripped() {
+		t.Errorf("Expected circuit breaker to close after successful probe")
+	}
+}
+
+func TestCircuitBreakerLeavesUserPause(t *testing.T) {
+	ch := &fakeChannel{}
+	pq := PulseQueue{ch: ch, state: newQueueState()}
+	b := newCircuitBreaker(&CircuitBreakerPolicy{FailureThreshold: 1}, pq)
+
+	if err := pq.Pause(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, probe := range []bool{true, false} {
+		if err := b.resume(probe); err != nil || !pq.state.paused || len(ch.consumers) != 0 {
+			t.Errorf("Expected queue paused by user to stay paused (probe: %v), but got %v and %v consumers", probe, err, len(ch.consumers))
+		}
+	}
+
+	// once resumed by the user, the circuit breaker pauses and resumes it
+	pq.Resume()
+	b.pause()
+	if err := b.resume(true); err != nil || pq.state.paused || len(ch.consumers) != 2 {
+		t.Errorf("Expected circuit breaker to resume queue it paused, but got %v and %v consumers", err, len(ch.consumers))
+	}
+}
+
@@ -0,0 +1,253 @@
+package pulse
+
+import (
+	"log"
+
+	"github.com/streadway/amqp"
+)
+
+// OnError registers a callback that is called with the reason the queue
+// stopped being consumed, if it was not closed by calling Close (see Err).
+// Its Kind (see PulseError) tells why, e.g. ErrQueueDeleted if Pulse Guardian
+// deleted the queue, or ErrConnection if the connection dropped. If the queue
+// is consumed with ConsumeOptions.Redeclare, the callback is also called when
+// the server cancels its consumer, before the queue is redeclared. If the
+// queue has already stopped being consumed, the callback is called
+// immediately.
+func (pq *PulseQueue) OnError(callback func(err error)) {
+	if pq.state == nil {
+		return
+	}
+	pq.state.mu.Lock()
+	pq.state.onError = callback
+	err := pq.state.err
+	pq.state.mu.Unlock()
+	if err != nil && callback != nil {
+		callback(err)
+	}
+}
+
+// fail records err as the reason the queue stopped being consumed, unless
+// one has already been recorded, and reports it to the error callback of the
+// queue. It returns the recorded reason.
+func (pq *PulseQueue) fail(err error) error {
+	pq.state.mu.Lock()
+	if pq.state.err != nil {
+		err = pq.state.err
+		pq.state.mu.Unlock()
+		return err
+	}
+	pq.state.err = err
+	onError := pq.state.onError
+	pq.state.mu.Unlock()
+	if onError != nil {
+		onError(err)
+	}
+	return err
+}
+
+// report reports err to the error callback of the queue, without recording
+// it as the reason the queue stopped being consumed
+func (pq *PulseQueue) report(err error) {
+	pq.state.mu.Lock()
+	onError := pq.state.onError
+	pq.state.mu.Unlock()
+	if onError != nil {
+		onError(err)
+	}
+}
+
+// consumerCancelled reports whether the deliveries of the consumer of the
+// queue ended because the server cancelled it, rather than because the queue
+// was paused or its channel closed. If so, the queue is marked as recovering
+// until recover is done, so that pausing and resuming the queue in the
+// meantime do not touch the cancelled consumer.
+func (pq *PulseQueue) consumerCancelled() bool {
+	// the server sends the tag before the deliveries end
+	select {
+	case tag, ok := <-pq.cancelled:
+		if !ok {
+			return false
+		}
+		pq.state.mu.Lock()
+		defer pq.state.mu.Unlock()
+		if tag != pq.state.consumer || pq.state.paused {
+			return false
+		}
+		pq.state.recovering = true
+		return true
+	default:
+		return false
+	}
+}
+
+// cancellation returns the error describing why the server cancelled the
+// consumer of the queue: ErrQueueDeleted if the queue no longer exists, and
+// otherwise ErrConsumerCancelled.
+func (pq *PulseQueue) cancellation() error {
+	err := pq.opError("consume", ErrConsumerCancelled, nil, "Consumer of queue "+pq.state.queue+" was cancelled by the server")
+	if pq.state.deleted() {
+		err.Message = "Queue " + pq.state.queue + " was deleted"
+		err.Kind = ErrQueueDeleted
+	}
+	return err
+}
+
+// queueDeleted reports whether the given queue no longer exists
+func queueDeleted(conn *amqp.Connection, queue string) bool {
+	// a failed passive declaration closes the channel it was made on, so use
+	// a separate channel
+	ch, err := conn.Channel()
+	if err != nil {
+		return false
+	}
+	defer ch.Close()
+	_, err = ch.QueueDeclarePassive(
+		queue, // name
+		false, // durable
+		false, // delete when usused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	amqpErr, ok := err.(*amqp.Error)
+	return ok && amqpErr.Code == amqp.NotFound
+}
+
+// recover handles the cancellation of the consumer of the queue by the
+// server. If the queue is consumed with ConsumeOptions.Redeclare, it
+// redeclares the queue and returns the deliveries of a new consumer (or, if
+// the queue has been paused in the meantime, waits for it to be resumed).
+// Otherwise, or if that fails, it records why the queue stopped being
+// consumed, and returns nil.
+func (pq *PulseQueue) recover(closed <-chan *amqp.Error) <-chan amqp.Delivery {
+	err := pq.cancellation()
+	pq.state.mu.Lock()
+	redeclare := pq.state.redeclare
+	pq.state.mu.Unlock()
+	if redeclare == nil {
+		pq.fail(err)
+		return nil
+	}
+	log.Printf("%v - redeclaring queue", err)
+	pq.report(err)
+	deliveries, paused, err := pq.redeclare(redeclare)
+	if err != nil {
+		pq.fail(err)
+		return nil
+	}
+	if paused {
+		return pq.waitForResume(closed)
+	}
+	return deliveries
+}
+
+// redeclare redeclares the queue, and registers a new consumer unless the
+// queue is paused. The queue state is locked throughout, so that the queue
+// is not paused or resumed, nor its prefetch changed, half way through.
+func (pq *PulseQueue) redeclare(redeclare func() error) (deliveries <-chan amqp.Delivery, paused bool, err error) {
+	pq.state.mu.Lock()
+	defer pq.state.mu.Unlock()
+	if err := redeclare(); err != nil {
+		return nil, false, err
+	}
+	pq.state.recovering = false
+	if pq.state.paused {
+		return nil, true, nil
+	}
+	deliveries, err = pq.consume()
+	if err != nil {
+		return nil, false, pq.opError("consume", nil, err, "Failed to register a consumer for redeclared queue "+pq.state.queue)
+	}
+	return deliveries, false, nil
+}
+
+// closeError returns the error describing why the server closed the channel
+// of a queue
+func closeError(amqpErr *amqp.Error) error {
+	err := opError("consume", nil, amqpErr, "AMQP channel closed")
+	switch {
+	case amqpErr.Code == amqp.AccessRefused:
+		err.Kind = ErrAccessRefused
+	case amqpErr.Server && amqpErr.Recover:
+		// soft errors only close the channel they occur on
+		err.Kind = ErrChannelClosed
+	default:
+		err.Kind = ErrConnection
+	}
+	return err
+}
+
+// queueChannel is the part of *amqp.Channel used for declaring and binding
+// a queue
+type queueChannel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+// declareQueue declares the given queue. Anonymous queues are exclusive to
+// the connection, and deleted once it closes.
+func declareQueue(ch queueChannel, name string, anonymous bool, options ConsumeOptions) (amqp.Queue, error) {
+	if anonymous {
+		return ch.QueueDeclare(
+			name,  // name
+			false, // durable
+			// unnamed queues get deleted when disconnected
+			true, // delete when usused
+			// unnamed queues are exclusive
+			true,  // exclusive
+			false, // no-wait
+			nil,   // arguments
+		)
+	}
+	return ch.QueueDeclare(
+		name,                    // name
+		durable(options),        // durable
+		false,                   // delete when usused
+		false,                   // exclusive
+		false,                   // no-wait
+		queueArguments(options), // arguments
+	)
+}
+
+// redeclareQueue declares the given queue again after it has been deleted,
+// together with its retry and dead letter queues, and binds it to the
+// given bindings.
+func (c *Connection) redeclareQueue(ch *amqp.Channel, queue string, anonymous bool, options ConsumeOptions, bindings *bindingSet) error {
+	if err := c.declareAndBind(ch, queue, anonymous, options, bindings.bindings()); err != nil {
+		return err
+	}
+	// the exchanges survive, but the bindings of the queue to them do not
+	if options.DeadLetter != nil {
+		if _, err := c.declareDeadLetterQueue(ch, queue, anonymous, options.DeadLetter); err != nil {
+			return err
+		}
+	}
+	if options.Retry != nil {
+		if _, err := c.declareRetryQueues(ch, queue, anonymous, options.Retry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// declareAndBind declares the given queue as it was originally declared,
+// and binds it to the given bindings
+func (c *Connection) declareAndBind(ch queueChannel, queue string, anonymous bool, options ConsumeOptions, bindings []Binding) error {
+	_, err := declareQueue(ch, queue, anonymous, options)
+	if err != nil {
+		return c.opError("declare queue", ErrQueueDeclare, err, "Failed to redeclare queue")
+	}
+	for _, binding := range bindings {
+		err = ch.QueueBind(
+			queue,                  // queue name
+			binding.RoutingKey(),   // routing key
+			binding.ExchangeName(), // exchange
+			false,
+			nil)
+		if err != nil {
+			return c.opError("bind queue", nil, err, "Failed to bind a queue")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package pulse
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestCloseError(t *testing.T) {
+	for _, test := range []struct {
+		err  *amqp.Error
+		kind error
+	}{
+		{amqp.ErrClosed, ErrConnection},
+		{&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - Closed via management plugin", Server: true}, ErrConnection},
+		{&amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED", Server: true, Recover: true}, ErrAccessRefused},
+		{&amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - unknown delivery tag 1", Server: true, Recover: true}, ErrChannelClosed},
+	} {
+		err := closeError(test.err)
+		if !errors.Is(err, test.kind) {
+			t.Errorf("Expected %v to be classified as %v, but got %v", test.err, test.kind, err)
+		}
+		var amqpErr *amqp.Error
+		if !errors.As(err, &amqpErr) || amqpErr != test.err {
+			t.Errorf("Expected %v to wrap the AMQP error", err)
+		}
+	}
+}
+
+func TestOnError(t *testing.T) {
+	pq := PulseQueue{state: newQueueState()}
+	var reported []error
+	pq.OnError(func(err error) { reported = append(reported, err) })
+
+	cancelled := opError("consume", ErrConsumerCancelled, nil, "Consumer was cancelled by the server")
+	pq.report(cancelled)
+	if len(reported) != 1 || pq.Err() != nil {
+		t.Fatalf("Expected error to be reported without stopping the queue, but got %v and %v", reported, pq.Err())
+	}
+
+	deleted := opError("consume", ErrQueueDeleted, nil, "Queue was deleted")
+	if err := pq.fail(deleted); !errors.Is(err, ErrQueueDeleted) {
+		t.Errorf("Expected queue to fail with ErrQueueDeleted, but got %v", err)
+	}
+	if err := pq.fail(closeError(amqp.ErrClosed)); !errors.Is(err, ErrQueueDeleted) {
+		t.Errorf("Expected first reason to be kept, but got %v", err)
+	}
+	if len(reported) != 2 || !errors.Is(pq.Err(), ErrQueueDeleted) {
+		t.Errorf("Expected reason to be reported once and recorded, but got %v and %v", reported, pq.Err())
+	}
+
+	// callbacks registered later learn of the reason immediately
+	var late error
+	pq.OnError(func(err error) { late = err })
+	if !errors.Is(late, ErrQueueDeleted) {
+		t.Errorf("Expected late callback to be called with the reason, but got %v", late)
+	}
+}
+
+func TestConsumerCancelled(t *testing.T) {
+	pq := PulseQueue{state: newQueueState(), cancelled: make(chan string, 4)}
+	pq.state.consumer = "consumer/a"
+	if pq.consumerCancelled() {
+		t.Errorf("Expected consumer not to be cancelled without notification")
+	}
+	pq.cancelled <- "consumer/a"
+	if !pq.consumerCancelled() {
+		t.Errorf("Expected consumer to be cancelled")
+	}
+	pq.state.paused = true
+	pq.cancelled <- "consumer/a"
+	if pq.consumerCancelled() {
+		t.Errorf("Expected end of deliveries of paused queue not to be a cancellation")
+	}
+	close(pq.cancelled)
+	if pq.consumerCancelled() {
+		t.Errorf("Expected closed channel not to be a cancellation")
+	}
+}
+
+// fakeChannel records the consumers registered on it, whose deliveries are
+// fed by the test, and the messages published on it, which are confirmed
+// unless their routing key is unroutable. Get returns the messages of
+// queue, in order.
+type fakeChannel struct {
+	mu         sync.Mutex
+	consumers  []chan amqp.Delivery
+	cancelled  []string
+	closed     bool
+	confirms   chan amqp.Confirmation
+	returns    chan amqp.Return
+	published  []fakePublishing
+	unroutable string
+	queue      []amqp.Delivery
+	purged     string
+}
+
+// fakePublishing is a message published on a fakeChannel
+type fakePublishing struct {
+	exchange, routingKey string
+	msg                  amqp.Publishing
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	deliveries := make(chan amqp.Delivery)
+	ch.consumers = append(ch.consumers, deliveries)
+	return deliveries, nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.cancelled = append(ch.cancelled, consumer)
+	return nil
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	return c
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.closed = true
+	return nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirms = confirm
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.returns = c
+	return c
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.published = append(ch.published, fakePublishing{exchange, key, msg})
+	if mandatory && key == ch.unroutable {
+		ch.returns <- amqp.Return{ReplyText: "NO_ROUTE", RoutingKey: key}
+	}
+	ch.confirms <- amqp.Confirmation{DeliveryTag: uint64(len(ch.published)), Ack: true}
+	return nil
+}
+
+func (ch *fakeChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if len(ch.queue) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	d := ch.queue[0]
+	ch.queue = ch.queue[1:]
+	d.MessageCount = uint32(len(ch.queue))
+	return d, true, nil
+}
+
+func (ch *fakeChannel) QueuePurge(name string, noWait bool) (int, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.purged = name
+	count := len(ch.queue)
+	ch.queue = nil
+	return count, nil
+}
+
+// consumer returns the deliveries of the i-th consumer registered
+func (ch *fakeChannel) consumer(t *testing.T, i int) chan amqp.Delivery {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		ch.mu.Lock()
+		if len(ch.consumers) > i {
+			deliveries := ch.consumers[i]
+			ch.mu.Unlock()
+			return deliveries
+		}
+		ch.mu.Unlock()
+	}
+	t.Fatalf("Expected consumer %v to be registered", i)
+	return nil
+}
+
+// pumpedQueue returns a queue consumed on a fake channel, whose deliveries
+// are forwarded by pump to the returned channel
+func pumpedQueue(t *testing.T, deleted bool) (PulseQueue, *fakeChannel, <-chan amqp.Delivery) {
+	ch := &fakeChannel{}
+	pq := PulseQueue{
+		ch:        ch,
+		closed:    make(chan *amqp.Error, 1),
+		cancelled: make(chan string, 4),
+		state:     newQueueState(),
+	}
+	pq.state.queue = "queue/alice/tasks"
+	pq.state.consumer = "consumer/a"
+	pq.state.deleted = func() bool { return deleted }
+	deliveries, _ := pq.consume()
+	out := make(chan amqp.Delivery)
+	go pq.pump(deliveries, out)
+	return pq, ch, out
+}
+
+// cancelConsumer simulates the server cancelling the consumer of the queue
+func cancelConsumer(pq PulseQueue, deliveries chan amqp.Delivery) {
+	pq.cancelled <- pq.state.consumer
+	close(deliveries)
+}
+
+func TestServerCancelStopsQueue(t *testing.T) {
+	for _, test := range []struct {
+		deleted bool
+		kind    error
+	}{
+		{true, ErrQueueDeleted},
+		{false, ErrConsumerCancelled},
+	} {
+		pq, ch, out := pumpedQueue(t, test.deleted)
+		var reported error
+		pq.OnError(func(err error) { reported = err })
+		deliveries := ch.consumer(t, 0)
+		deliveries <- amqp.Delivery{DeliveryTag: 1}
+		if d := <-out; d.DeliveryTag != 1 {
+			t.Errorf("Expected delivery to be forwarded, but got %v", d.DeliveryTag)
+		}
+		cancelConsumer(pq, deliveries)
+		if _, ok := <-out; ok {
+			t.Fatalf("Expected deliveries to end once consumer is cancelled")
+		}
+		if err := pq.stopped(); !errors.Is(err, test.kind) || !errors.Is(reported, test.kind) {
+			t.Errorf("Expected queue to stop with %v, but got %v (reported %v)", test.kind, err, reported)
+		}
+		if !ch.closed {
+			t.Errorf("Expected channel of cancelled consumer to be closed")
+		}
+	}
+}
+
+func TestServerCancelRedeclaresQueue(t *testing.T) {
+	pq, ch, out := pumpedQueue(t, true)
+	redeclared := make(chan bool, 2)
+	pq.state.redeclare = func() error {
+		redeclared <- true
+		return nil
+	}
+	var reported []error
+	pq.OnError(func(err error) { reported = append(reported, err) })
+
+	cancelConsumer(pq, ch.consumer(t, 0))
+	deliveries := ch.consumer(t, 1)
+	deliveries <- amqp.Delivery{DeliveryTag: 2}
+	if d := <-out; d.DeliveryTag != 2 {
+		t.Errorf("Expected delivery of new consumer to be forwarded, but got %v", d.DeliveryTag)
+	}
+	if len(redeclared) != 1 || len(reported) != 1 || !errors.Is(reported[0], ErrQueueDeleted) || pq.Err() != nil {
+		t.Errorf("Expected queue to be redeclared once and keep being consumed, but got %v redeclarations, %v reported and %v", len(redeclared), reported, pq.Err())
+	}
+
+	// consumers cancelled again are replaced again
+	cancelConsumer(pq, deliveries)
+	close(ch.consumer(t, 2))
+	if _, ok := <-out; ok || len(redeclared) != 2 {
+		t.Errorf("Expected deliveries to end after queue was redeclared again, but got %v redeclarations", len(redeclared))
+	}
+}
+
+func TestPauseWhileRecovering(t *testing.T) {
+	ch := &fakeChannel{}
+	pq := PulseQueue{ch: ch, cancelled: make(chan string, 4), state: newQueueState()}
+	pq.state.consumer = "consumer/a"
+	pq.state.deleted = func() bool { return false }
+	pq.state.redeclare = func() error { return nil }
+
+	pq.cancelled <- "consumer/a"
+	if !pq.consumerCancelled() {
+		t.Fatalf("Expected consumer to be cancelled")
+	}
+	if err := pq.Pause(); err != nil || len(ch.cancelled) != 0 {
+		t.Errorf("Expected pausing not to cancel the cancelled consumer, but got %v and %v", err, ch.cancelled)
+	}
+	// the redeclared queue is consumed once resumed
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pq.Resume()
+	}()
+	if deliveries := pq.recover(make(chan *amqp.Error)); deliveries == nil || len(ch.consumers) != 1 {
+		t.Errorf("Expected redeclared queue to be consumed once resumed, but got %v consumers", len(ch.consumers))
+	}
+}
+
+func TestDeclareAndBind(t *testing.T) {
+	for _, anonymous := range []bool{true, false} {
+		ch := &declaringChannel{}
+		c := &Connection{}
+		options := ConsumeOptions{QueueType: QuorumQueue}
+		if anonymous {
+			options = ConsumeOptions{}
+		}
+		err := c.declareAndBind(ch, "queue/alice/tasks", anonymous, options, []Binding{Bind("#", "exchange/a"), Bind("a.*", "exchange/b")})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if ch.durable == anonymous || ch.exclusive != anonymous || ch.autoDelete != anonymous {
+			t.Errorf("Expected queue (anonymous: %v) to be declared as originally, but got %#v", anonymous, ch)
+		}
+		if len(ch.bindings) != 2 || ch.bindings[1] != "exchange/b a.*" {
+			t.Errorf("Expected queue to be bound again, but got %v", ch.bindings)
+		}
+	}
+}
+
+// declaringChannel records how a queue is declared and bound
+type declaringChannel struct {
+	durable, autoDelete, exclusive bool
+	bindings                       []string
+}
+
+func (ch *declaringChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.durable, ch.autoDelete, ch.exclusive = durable, autoDelete, exclusive
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *declaringChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	ch.bindings = append(ch.bindings, exchange+" "+key)
+	return nil
+}
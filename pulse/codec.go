@@ -0,0 +1,207 @@
+package pulse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Codec decodes the body of a message into a payload.
+type Codec interface {
+	// Decode decodes body, typically into payloadObject (the object
+	// returned by NewPayloadObject of the binding the message matched), and
+	// returns the payload to pass on to the callback.
+	Decode(body []byte, payloadObject interface{}) (interface{}, error)
+}
+
+// CodecFunc is an adapter to allow the use of ordinary functions as a Codec.
+type CodecFunc func(body []byte, payloadObject interface{}) (interface{}, error)
+
+// Decode calls f(body, payloadObject)
+func (f CodecFunc) Decode(body []byte, payloadObject interface{}) (interface{}, error) {
+	return f(body, payloadObject)
+}
+
+var (
+	// JSONCodec unmarshals json bodies into the payload object. This is the
+	// default codec.
+	JSONCodec Codec = CodecFunc(decodeJSON)
+	// GzipJSONCodec unmarshals gzip-compressed json bodies into the payload
+	// object. It is intended for bindings to exchanges whose publishers
+	// compress messages without setting a content encoding. Messages with
+	// content encoding "gzip" are decompressed before being passed to any
+	// other codec, but not to GzipJSONCodec, so that they are only
+	// decompressed once.
+	GzipJSONCodec Codec = gzipJSONCodec{}
+	// RawCodec skips decoding, and passes on the body unchanged, as a
+	// []byte. It is never used by default, not even for messages with
+	// content type "application/octet-stream"; see WithCodec and
+	// RegisterCodec.
+	RawCodec Codec = CodecFunc(decodeRaw)
+)
+
+func decodeJSON(body []byte, payloadObject interface{}) (interface{}, error) {
+	return payloadObject, json.Unmarshal(body, payloadObject)
+}
+
+// gzipJSONCodec is the type of GzipJSONCodec, which decompresses bodies
+// itself
+type gzipJSONCodec struct{}
+
+func (gzipJSONCodec) Decode(body []byte, payloadObject interface{}) (interface{}, error) {
+	body, err := gunzip(body)
+	if err != nil {
+		return payloadObject, err
+	}
+	return decodeJSON(body, payloadObject)
+}
+
+func decodeRaw(body []byte, payloadObject interface{}) (interface{}, error) {
+	return body, nil
+}
+
+// MaxDecompressedSize is the maximum size, in bytes, of a gzip-compressed
+// message body once decompressed. Larger bodies fail to decode with a
+// *DecodeError, so that a small compressed message cannot exhaust memory.
+var MaxDecompressedSize int64 = 64 << 20
+
+// errBodyTooLarge is returned when a decompressed body exceeds
+// MaxDecompressedSize
+var errBodyTooLarge = errors.New("decompressed message body exceeds maximum size")
+
+func gunzip(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	limit := MaxDecompressedSize
+	body, err = io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w of %v bytes", errBodyTooLarge, limit)
+	}
+	return body, nil
+}
+
+var (
+	codecsMutex sync.RWMutex
+	// codecs maps content types to the codecs that decode them
+	codecs = map[string]Codec{
+		"":                 JSONCodec,
+		"application/json": JSONCodec,
+	}
+)
+
+// RegisterCodec registers the codec for decoding messages with the given
+// content type (e.g. "application/msgpack"), replacing any codec previously
+// registered for it. Messages whose content type has no registered codec are
+// decoded as json, unless the binding they matched specifies a codec (see
+// WithCodec).
+func RegisterCodec(contentType string, codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[contentType] = codec
+}
+
+// codecFor returns the codec registered for the given content type
+func codecFor(contentType string) Codec {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	if codec, ok := codecs[contentType]; ok {
+		return codec
+	}
+	return JSONCodec
+}
+
+// CodecBinding is a Binding that specifies the codec for decoding the
+// messages it matches, regardless of their content type.
+type CodecBinding interface {
+	Binding
+
+	// This should return the codec for decoding matching messages
+	Codec() Codec
+}
+
+// codecBinding decorates a Binding with a codec
+type codecBinding struct {
+	Binding
+	codec Codec
+}
+
+// WithCodec returns a CodecBinding that behaves like binding, but decodes
+// the messages it matches with codec. For example:
+//
+//  	pulse.WithCodec(pulse.Bind("#", "exchange/build/normalized"), pulse.RawCodec)
+func WithCodec(binding Binding, codec Codec) CodecBinding {
+	return &codecBinding{
+		Binding: binding,
+		codec:   codec,
+	}
+}
+
+// Codec returns the codec the codecBinding was created with in the WithCodec
+// function above
+func (b *codecBinding) Codec() Codec {
+	return b.codec
+}
+
+// Unwrap returns the decorated binding
+func (b *codecBinding) Unwrap() Binding {
+	return b.Binding
+}
+
+// decodePayload decodes the body of a delivery that matched the given
+// binding. The body is decoded with the codec of the binding if it is a
+// CodecBinding, or otherwise with the codec registered for its content type,
+// after being decompressed if its content encoding is "gzip" (unless the codec
+// is GzipJSONCodec, which decompresses it itself). If the binding
+// was created by WithValidation, the body is validated first, and any failure
+// is returned as a *DecodeError.
+func decodePayload(binding Binding, d amqp.Delivery) (interface{}, error) {
+	payloadObject := binding.NewPayloadObject()
+	codec := codecFor(d.ContentType)
+	validation, validating := findBinding[*validatingBinding](binding)
+	if validating && validation.strict && (d.ContentType == "" || d.ContentType == "application/json") {
+		codec = StrictJSONCodec
+	}
+	if codecBinding, ok := findBinding[CodecBinding](binding); ok && codecBinding.Codec() != nil {
+		codec = codecBinding.Codec()
+	}
+	body := d.Body
+	// other content encodings (e.g. "utf-8", which some publishers set)
+	// leave the body unchanged
+	if _, decompresses := codec.(gzipJSONCodec); d.ContentEncoding == "gzip" && !decompresses {
+		var err error
+		body, err = gunzip(body)
+		if errors.Is(err, errBodyTooLarge) {
+			return payloadObject, newDecodeError(d, d.Body, err)
+		}
+		if err != nil {
+			return payloadObject, err
+		}
+	}
+	if !validating {
+		payload, err := codec.Decode(body, payloadObject)
+		if errors.Is(err, errBodyTooLarge) {
+			return payload, newDecodeError(d, body, err)
+		}
+		return payload, err
+	}
+	if err := validation.validate(body); err != nil {
+		return payloadObject, newDecodeError(d, body, err)
+	}
+	payload, err := codec.Decode(body, payloadObject)
+	if err != nil {
+		return payload, newDecodeError(d, body, err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,81 @@
+package pulse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatalf("Could not compress %q: %v", s, err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodePayload(t *testing.T) {
+	binding := &typedBinding{rk: "#", en: "exchange/test"}
+	testDecode := func(binding Binding, d amqp.Delivery, check func(interface{}) bool) {
+		payload, err := decodePayload(binding, d)
+		if err != nil {
+			t.Errorf("Could not decode %#v: %v", d, err)
+		} else if !check(payload) {
+			t.Errorf("Unexpected payload %#v decoded from %#v", payload, d)
+		}
+	}
+	isABC := func(payload interface{}) bool {
+		p, ok := payload.(*taskDefined)
+		return ok && p.TaskID == "abc"
+	}
+	testDecode(binding, amqp.Delivery{Body: []byte(`{"taskId": "abc"}`)}, isABC)
+	testDecode(binding, amqp.Delivery{Body: []byte(`{"taskId": "abc"}`), ContentType: "application/json", ContentEncoding: "utf-8"}, isABC)
+	testDecode(binding, amqp.Delivery{Body: gzipped(t, `{"taskId": "abc"}`), ContentEncoding: "gzip"}, isABC)
+	testDecode(WithCodec(binding, GzipJSONCodec), amqp.Delivery{Body: gzipped(t, `{"taskId": "abc"}`)}, isABC)
+	// the body is only decompressed once
+	testDecode(WithCodec(binding, GzipJSONCodec), amqp.Delivery{Body: gzipped(t, `{"taskId": "abc"}`), ContentEncoding: "gzip"}, isABC)
+	// raw decoding is opt-in
+	testDecode(binding, amqp.Delivery{Body: []byte(`{"taskId": "abc"}`), ContentType: "application/octet-stream"}, isABC)
+	testDecode(WithCodec(binding, RawCodec), amqp.Delivery{Body: []byte("raw")}, func(payload interface{}) bool {
+		b, ok := payload.([]byte)
+		return ok && string(b) == "raw"
+	})
+
+	RegisterCodec("text/x-task-id", CodecFunc(func(body []byte, payloadObject interface{}) (interface{}, error) {
+		payloadObject.(*taskDefined).TaskID = strings.TrimSpace(string(body))
+		return payloadObject, nil
+	}))
+	testDecode(binding, amqp.Delivery{Body: []byte("abc\n"), ContentType: "text/x-task-id"}, isABC)
+
+	if _, err := decodePayload(binding, amqp.Delivery{Body: []byte("not gzip"), ContentEncoding: "gzip"}); err == nil {
+		t.Errorf("Expected error decoding invalid gzip body")
+	}
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	defer func(limit int64) { MaxDecompressedSize = limit }(MaxDecompressedSize)
+	MaxDecompressedSize = 16
+	binding := &typedBinding{rk: "#", en: "exchange/test"}
+	if _, err := decodePayload(binding, amqp.Delivery{Body: gzipped(t, `{"taskId": "a"}`), ContentEncoding: "gzip"}); err != nil {
+		t.Errorf("Expected body within limit to decode, but got %v", err)
+	}
+	large := gzipped(t, `{"taskId": "`+strings.Repeat("a", 1000)+`"}`)
+	for _, d := range []struct {
+		binding Binding
+		d       amqp.Delivery
+	}{
+		{binding, amqp.Delivery{Body: large, ContentEncoding: "gzip"}},
+		{WithCodec(binding, GzipJSONCodec), amqp.Delivery{Body: large}},
+	} {
+		var decodeErr *DecodeError
+		if _, err := decodePayload(d.binding, d.d); !errors.As(err, &decodeErr) {
+			t.Errorf("Expected *DecodeError for body exceeding limit, but got %v", err)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package pulse
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers used for tracking redeliveries of messages, and for recording why
+// a message was moved to a dead letter queue.
+const (
+	headerRedeliveries  = "x-pulse-redeliveries"
+	headerFailureReason = "x-pulse-failure-reason"
+)
+
+// DeadLetterPolicy describes how to handle poison messages, i.e. messages
+// that are redelivered over and over again, because the callback keeps
+// failing to process them (or crashes while processing them).
+//
+// Redeliveries of a message are counted using the quorum queue header
+// "x-delivery-count", the "x-death" header added by the broker when a
+// message is dead-lettered, and header "x-pulse-redeliveries". Retries (see
+// RetryPolicy) are not redeliveries: a message that has used up its retries
+// is moved to the dead letter queue by the retry policy. Since the broker
+// only flags that a message of a classic queue has been redelivered, without
+// counting how many times, a message that is redelivered by the broker (e.g.
+// after a crash), or that is nacked or rejected with requeue=true (and no
+// RetryPolicy is set), is republished to the back of the queue with an
+// incremented "x-pulse-redeliveries" header. Such messages are therefore
+// delivered again after the messages that were queued behind them, rather
+// than in their original order.
+//
+// When a message has been redelivered more than MaxRedeliveries times, it is
+// moved to the dead letter queue "<queue>/dead-letter" instead of being
+// passed to the callback, with the reason recorded in header
+// "x-pulse-failure-reason". The dead letter queue can be inspected, replayed
+// and purged with the DeadLetters, ReplayDeadLetters and PurgeDeadLetters
+// methods of PulseQueue. For an anonymous queue, the dead letter queue is
+// exclusive, and so is deleted when the connection is closed.
+type DeadLetterPolicy struct {
+	// MaxRedeliveries is the number of times a message may be redelivered
+	// before it is moved to the dead letter queue
+	MaxRedeliveries int
+}
+
+// DeadLetter is a message in a dead letter queue
+type DeadLetter struct {
+	// Delivery is the dead-lettered message, with its original exchange and
+	// routing key restored
+	Delivery amqp.Delivery
+	// Reason describes why the message was dead-lettered
+	Reason string
+	// Redeliveries is the number of times the message was redelivered
+	// before it was dead-lettered
+	Redeliveries int
+}
+
+// deadLetterQueue manages the dead letter queue of a consumed queue
+type deadLetterQueue struct {
+	policy *DeadLetterPolicy
+	// open opens a dedicated channel for fetching and purging the messages
+	// of the dead letter queue, which is therefore independent of the
+	// channel the queue is consumed on
+	open func() (deadLetterChannel, error)
+	// publisher moves messages to the dead letter queue, and back to the
+	// consumed queue (see PulseQueue.publisher)
+	publisher *publisher
+	exchange  string
+	// queue is the name of the consumed queue
+	queue string
+	// name is the name of the dead letter queue
+	name string
+}
+
+// deadLetterChannel is the part of *amqp.Channel used for fetching and
+// purging the messages of a dead letter queue
+type deadLetterChannel interface {
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	Close() error
+}
+
+func openDeadLetterChannel(conn *amqp.Connection) func() (deadLetterChannel, error) {
+	return func() (deadLetterChannel, error) {
+		return conn.Channel()
+	}
+}
+
+// declareDeadLetterQueue declares the dead letter exchange and the dead
+// letter queue for the given queue, and binds them together. The consumed
+// queue is also bound to the dead letter exchange, in order that messages
+// can be republished to it.
+func (c *Connection) declareDeadLetterQueue(ch *amqp.Channel, queue string, anonymous bool, policy *DeadLetterPolicy) (*deadLetterQueue, error) {
+	dl := &deadLetterQueue{
+		policy:   policy,
+		open:     openDeadLetterChannel(c.AMQPConn),
+		exchange: "exchange/" + c.User + "/dead-letter",
+		queue:    queue,
+		name:     queue + "/dead-letter",
+	}
+	err := ch.ExchangeDeclare(
+		dl.exchange, // name
+		"direct",    // type
+		true,        // durable
+		false,       // auto-deleted
+		false,       // internal
+		false,       // no-wait
+		nil,         // arguments
+	)
+	if err != nil {
+		return nil, c.opError("declare exchange", nil, err, "Failed to declare dead letter exchange "+dl.exchange)
+	}
+	_, err = ch.QueueDeclare(
+		dl.name,   // name
+		false,     // durable
+		false,     // delete when usused
+		anonymous, // exclusive
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		return nil, c.opError("declare queue", ErrQueueDeclare, err, "Failed to declare dead letter queue")
+	}
+	for _, name := range []string{dl.name, queue} {
+		err = ch.QueueBind(
+			name,        // queue name
+			name,        // routing key
+			dl.exchange, // exchange
+			false,
+			nil)
+		if err != nil {
+			return nil, c.opError("bind queue", nil, err, "Failed to bind queue to dead letter exchange")
+		}
+	}
+	return dl, nil
+}
+
+// redeliveries returns how many times the delivery has been redelivered
+func (dl *deadLetterQueue) redeliveries(d amqp.Delivery) int {
+	count := headerInt(d.Headers, headerRedeliveries)
+	for _, n := range []int{
+		headerInt(d.Headers, "x-delivery-count"),
+		deathCount(d.Headers, dl.queue+"/retry/"),
+	} {
+		if n > count {
+			count = n
+		}
+	}
+	if _, quorum := d.Headers["x-delivery-count"]; d.Redelivered && !quorum {
+		count++
+	}
+	return count
+}
+
+// deathCount returns the total number of times a message has been
+// dead-lettered, according to its x-death header, apart from expiring from
+// the retry queues whose names start with retryQueues, which are retries
+// rather than redeliveries (see RetryPolicy)
+func deathCount(headers amqp.Table, retryQueues string) int {
+	deaths, _ := headers["x-death"].([]interface{})
+	count := 0
+	for _, death := range deaths {
+		table, ok := death.(amqp.Table)
+		if !ok {
+			continue
+		}
+		if queue, _ := table["queue"].(string); strings.HasPrefix(queue, retryQueues) {
+			continue
+		}
+		count += headerInt(table, "count")
+	}
+	return count
+}
+
+// check moves the delivery to the dead letter queue if it has been
+// redelivered too many times, and republishes it with an updated
+// redelivery count if it was redelivered by the broker. It returns true if
+// it has taken care of the delivery, and it should therefore not be passed
+// to the callback.
+func (dl *deadLetterQueue) check(d amqp.Delivery) (bool, error) {
+	count := dl.redeliveries(d)
+	if count > dl.policy.MaxRedeliveries {
+		return true, dl.route(d, fmt.Sprintf("redelivered %d times", count))
+	}
+	if _, quorum := d.Headers["x-delivery-count"]; d.Redelivered && !quorum {
+		return true, dl.republish(d, count)
+	}
+	return false, nil
+}
+
+// wrap intercepts nacks and rejects with requeue=true, so that redeliveries
+// are counted.
+func (dl *deadLetterQueue) wrap(d amqp.Delivery) amqp.Delivery {
+	return interceptRequeue(d, dl.requeue)
+}
+
+// requeue republishes the delivery to the back of the consumed queue with an
+// incremented redelivery count, or moves it to the dead letter queue if it
+// has been redelivered too many times.
+func (dl *deadLetterQueue) requeue(d amqp.Delivery) error {
+	count := dl.redeliveries(d) + 1
+	if count > dl.policy.MaxRedeliveries {
+		return dl.route(d, fmt.Sprintf("requeued by consumer after %d redeliveries", count-1))
+	}
+	return dl.republish(d, count)
+}
+
+// republish publishes a copy of the delivery to the consumed queue with the
+// given redelivery count, and acks the original delivery
+func (dl *deadLetterQueue) republish(d amqp.Delivery, count int) error {
+	err := dl.publisher.publish(dl.exchange, dl.queue, republished(d, amqp.Table{
+		headerRedeliveries: int64(count),
+	}))
+	if err != nil {
+		return requeue(d, Error(err, "Failed to requeue message"))
+	}
+	return d.Ack(false)
+}
+
+// route moves the delivery to the dead letter queue, recording the given
+// reason
+func (dl *deadLetterQueue) route(d amqp.Delivery, reason string) error {
+	err := dl.publisher.publish(dl.exchange, dl.name, republished(d, amqp.Table{
+		headerFailureReason: reason,
+		headerRedeliveries:  int64(dl.redeliveries(d)),
+	}))
+	if err != nil {
+		return requeue(d, Error(err, "Failed to publish message to dead letter queue "+dl.name))
+	}
+	return d.Ack(false)
+}
+
+// DeadLetters returns up to max messages from the dead letter queue, without
+// removing them from it.
+func (pq *PulseQueue) DeadLetters(max int) ([]DeadLetter, error) {
+	if pq.deadLetters == nil {
+		return nil, Error(nil, "No dead letter queue configured")
+	}
+	// messages that are fetched but not acknowledged are returned to the
+	// dead letter queue when the channel is closed
+	ch, err := pq.deadLetters.open()
+	if err != nil {
+		return nil, Error(err, "Failed to open a channel")
+	}
+	defer ch.Close()
+	deadLetters := []DeadLetter{}
+	for len(deadLetters) < max {
+		d, ok, err := ch.Get(pq.deadLetters.name, false)
+		if err != nil {
+			return nil, Error(err, "Failed to fetch message from dead letter queue")
+		}
+		if !ok {
+			break
+		}
+		reason, _ := d.Headers[headerFailureReason].(string)
+		deadLetters = append(deadLetters, DeadLetter{
+			Delivery:     restoreOrigin(d),
+			Reason:       reason,
+			Redeliveries: headerInt(d.Headers, headerRedeliveries),
+		})
+	}
+	return deadLetters, nil
+}
+
+// ReplayDeadLetters moves all messages in the dead letter queue back to the
+// consumed queue, with their redelivery counts reset, returning the number
+// of messages replayed.
+func (pq *PulseQueue) ReplayDeadLetters() (int, error) {
+	if pq.deadLetters == nil {
+		return 0, Error(nil, "No dead letter queue configured")
+	}
+	ch, err := pq.deadLetters.open()
+	if err != nil {
+		return 0, Error(err, "Failed to open a channel")
+	}
+	defer ch.Close()
+	replayed := 0
+	for {
+		d, ok, err := ch.Get(pq.deadLetters.name, false)
+		if err != nil {
+			return replayed, Error(err, "Failed to fetch message from dead letter queue")
+		}
+		if !ok {
+			return replayed, nil
+		}
+		// the message stays in the dead letter queue unless it has been
+		// confirmed to be back in the consumed queue
+		err = pq.deadLetters.publisher.publish(pq.deadLetters.exchange, pq.deadLetters.queue, republished(restoreOrigin(d), amqp.Table{
+			headerFailureReason: nil,
+			headerRedeliveries:  nil,
+			headerRetries:       nil,
+			"x-death":           nil,
+		}))
+		if err != nil {
+			return replayed, Error(err, "Failed to replay message")
+		}
+		err = d.Ack(false)
+		if err != nil {
+			return replayed, Error(err, "Failed to remove replayed message from dead letter queue")
+		}
+		replayed++
+		// avoid replaying forever if messages are dead-lettered again as
+		// fast as they are replayed
+		if d.MessageCount == 0 {
+			return replayed, nil
+		}
+	}
+}
+
+// PurgeDeadLetters deletes all messages in the dead letter queue, returning
+// the number of messages deleted.
+func (pq *PulseQueue) PurgeDeadLetters() (int, error) {
+	if pq.deadLetters == nil {
+		return 0, Error(nil, "No dead letter queue configured")
+	}
+	// use a dedicated channel, in order that the dead letter queue can be
+	// purged even after the queue has stopped being consumed
+	ch, err := pq.deadLetters.open()
+	if err != nil {
+		return 0, Error(err, "Failed to open a channel")
+	}
+	defer ch.Close()
+	count, err := ch.QueuePurge(pq.deadLetters.name, false)
+	if err != nil {
+		return count, Error(err, "Failed to purge dead letter queue")
+	}
+	return count, nil
+}
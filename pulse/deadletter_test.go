@@ -0,0 +1,130 @@
+package pulse
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRedeliveries(t *testing.T) {
+	dl := &deadLetterQueue{queue: "queue/pmoore_test1/q"}
+	testRedeliveries := func(d amqp.Delivery, expected int) {
+		if actual := dl.redeliveries(d); actual != expected {
+			t.Errorf("Expected %v redeliveries but got %v for %#v", expected, actual, d)
+		}
+	}
+	testRedeliveries(amqp.Delivery{}, 0)
+	testRedeliveries(amqp.Delivery{Redelivered: true}, 1)
+	testRedeliveries(amqp.Delivery{Headers: amqp.Table{headerRedeliveries: int64(3)}}, 3)
+	testRedeliveries(amqp.Delivery{Redelivered: true, Headers: amqp.Table{headerRedeliveries: int64(3)}}, 4)
+	// quorum queues count redeliveries themselves
+	testRedeliveries(amqp.Delivery{Redelivered: true, Headers: amqp.Table{"x-delivery-count": int64(5)}}, 5)
+	// retries are not redeliveries
+	testRedeliveries(amqp.Delivery{Headers: amqp.Table{headerRetries: int32(2)}}, 0)
+	testRedeliveries(amqp.Delivery{Headers: amqp.Table{"x-death": []interface{}{
+		amqp.Table{"count": int64(2), "reason": "expired", "queue": "queue/pmoore_test1/q/retry/1s"},
+		amqp.Table{"count": int64(4), "reason": "rejected", "queue": "queue/pmoore_test1/other"},
+	}}}, 4)
+}
+
+func TestRetriesDoNotExhaustRedeliveries(t *testing.T) {
+	dl := &deadLetterQueue{
+		policy: &DeadLetterPolicy{MaxRedeliveries: 2},
+		queue:  "queue/pmoore_test1/q",
+		name:   "queue/pmoore_test1/q/dead-letter",
+	}
+	// with RetryPolicy{Delays: 3 delays}, a message on its last attempt,
+	// after three trips through the retry queue, has not been redelivered
+	d := amqp.Delivery{Headers: amqp.Table{
+		headerRetries: int64(3),
+		"x-death": []interface{}{
+			amqp.Table{"count": int64(3), "reason": "expired", "queue": "queue/pmoore_test1/q/retry/1s"},
+		},
+	}}
+	if handled, err := dl.check(d); handled || err != nil {
+		t.Errorf("Expected retried message to be passed to the callback, but it was handled (%v)", err)
+	}
+}
+
+func TestRouteToDeadLetterQueue(t *testing.T) {
+	ch := &fakeChannel{}
+	dl := &deadLetterQueue{
+		policy:    &DeadLetterPolicy{MaxRedeliveries: 2},
+		publisher: fakePublisher(ch),
+		exchange:  "exchange/pmoore_test1/dead-letter",
+		queue:     "queue/pmoore_test1/q",
+		name:      "queue/pmoore_test1/q/dead-letter",
+	}
+	ack := &recordingAcknowledger{}
+	d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Exchange: "exchange/build/", RoutingKey: "a.b", Redelivered: true, Headers: amqp.Table{headerRedeliveries: int64(2)}}
+	if handled, err := dl.check(d); !handled || err != nil {
+		t.Fatalf("Expected message redelivered too often to be dead-lettered, but got %v, %v", handled, err)
+	}
+	if len(ch.published) != 1 || ch.published[0].routingKey != dl.name || ch.published[0].msg.Headers[headerFailureReason] != "redelivered 3 times" {
+		t.Errorf("Expected message to be published to dead letter queue, but got %#v", ch.published)
+	}
+	if len(ack.acks) != 1 {
+		t.Errorf("Expected dead-lettered message to be acked, but got %#v", ack)
+	}
+
+	ch.unroutable = dl.name
+	ack = &recordingAcknowledger{}
+	d.Acknowledger = ack
+	if err := dl.route(d, "invalid"); err == nil {
+		t.Errorf("Expected error routing message to missing dead letter queue")
+	}
+	if len(ack.acks) != 0 || len(ack.nacks) != 1 || !ack.requeued[0] {
+		t.Errorf("Expected message that could not be dead-lettered to be requeued, but got %#v", ack)
+	}
+}
+
+func TestReplayAndPurgeDeadLetters(t *testing.T) {
+	ch := &fakeChannel{}
+	pq := PulseQueue{deadLetters: &deadLetterQueue{
+		open:      func() (deadLetterChannel, error) { return ch, nil },
+		publisher: fakePublisher(ch),
+		exchange:  "exchange/pmoore_test1/dead-letter",
+		queue:     "queue/pmoore_test1/q",
+		name:      "queue/pmoore_test1/q/dead-letter",
+	}}
+	ack := &recordingAcknowledger{}
+	for tag := uint64(1); tag <= 2; tag++ {
+		ch.queue = append(ch.queue, amqp.Delivery{Acknowledger: ack, DeliveryTag: tag, Headers: amqp.Table{
+			headerFailureReason:      "redelivered 3 times",
+			headerRedeliveries:       int64(3),
+			headerOriginalExchange:   "exchange/build/",
+			headerOriginalRoutingKey: "a.b",
+		}})
+	}
+	deadLetters, err := pq.DeadLetters(10)
+	if err != nil || len(deadLetters) != 2 || deadLetters[0].Reason != "redelivered 3 times" || deadLetters[0].Delivery.Exchange != "exchange/build/" {
+		t.Fatalf("Expected dead letters to be listed, but got %#v, %v", deadLetters, err)
+	}
+
+	ch.queue = []amqp.Delivery{deadLetters[0].Delivery, deadLetters[1].Delivery}
+	if replayed, err := pq.ReplayDeadLetters(); replayed != 2 || err != nil {
+		t.Fatalf("Expected 2 messages to be replayed, but got %v, %v", replayed, err)
+	}
+	for _, p := range ch.published {
+		if p.routingKey != "queue/pmoore_test1/q" || p.msg.Headers[headerFailureReason] != nil || p.msg.Headers[headerRedeliveries] != nil || p.msg.Headers[headerOriginalExchange] != "exchange/build/" {
+			t.Errorf("Expected message to be replayed to the consumed queue with its failure reset, but got %#v", p)
+		}
+	}
+	if len(ack.acks) != 2 {
+		t.Errorf("Expected replayed messages to be removed from the dead letter queue, but got %#v", ack)
+	}
+
+	// a message that cannot be replayed stays in the dead letter queue
+	ch.unroutable = "queue/pmoore_test1/q"
+	ch.queue = []amqp.Delivery{{Acknowledger: ack, DeliveryTag: 3}}
+	if replayed, err := pq.ReplayDeadLetters(); replayed != 0 || err == nil || len(ack.acks) != 2 {
+		t.Errorf("Expected unroutable message not to be replayed, but got %v, %v", replayed, err)
+	}
+
+	ch.queue = []amqp.Delivery{{}, {}, {}}
+	// the consumer channel may have closed, e.g. since the queue was deleted
+	pq.ch = &fakeChannel{closed: true}
+	if purged, err := pq.PurgeDeadLetters(); purged != 3 || err != nil || ch.purged != "queue/pmoore_test1/q/dead-letter" {
+		t.Errorf("Expected dead letter queue to be purged on a dedicated channel, but got %v, %v", purged, err)
+	}
+}
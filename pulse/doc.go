@@ -172,6 +172,12 @@
 // Scenario 3 is essentially the same as scenario 2 but with one consumer only.
 // Again, a named queue is required.
 //
+// Pulse requires queue names to begin with "queue/<user>/", so the library
+// prefixes queue names with this, and names unnamed queues with a random
+// UUID. To give queues predictable names instead, e.g. one per kubernetes
+// pod, set Connection.QueueNaming (see QueueNaming). Connection.QueueName
+// returns the name that a queue will be given.
+//
 // So, we're nearly done now. We now have a means to consume messages, by
 // calling the Consume method, and specifying a queue name, some bindings of
 // exchanges and routing keys, but how to actually process messages arriving on
@@ -217,6 +223,13 @@
 // http://godoc.org/github.com/taskcluster/taskcluster-client-go/queueevents#example-package--TaskClusterSniffer
 // for inspiration.
 //
+// Messages that are not plain json, such as gzip-compressed json, can be
+// decoded by a Codec, chosen either per binding (see WithCodec) or by the
+// content type of the message (see RegisterCodec). To catch upstream schema
+// changes, a binding can reject messages with unknown fields, or validate them
+// against the JSON Schema of the exchange, before they reach the callback (see
+// WithValidation).
+//
 // In this example above, we simply output the information we receive, and then
 // acknowledge receipt of the message. But why do we need to do this? To explain,
 // take a look at the remaining parameters to Consume that we pass in. There
@@ -242,6 +255,89 @@
 // acknowledging, having an idempotent message processing function (the
 // callback) should help avoid the problem of processing a message twice.
 //
+// If processing a message fails, you can nack it with requeue=true, so that it
+// will be delivered again. However if the failure is due to e.g. a downstream
+// service being temporarily unavailable, it is usually better to wait a while
+// before trying again. ConsumeWithOptions accepts a RetryPolicy for this, which
+// causes requeued messages to be redelivered after a delay:
+//
+//  	conn.ConsumeWithOptions(
+//  		"taskprocessing",
+//  		callback,
+//  		pulse.ConsumeOptions{
+//  			Prefetch: 1,
+//  			// retry after 1s, 2s, 4s, 8s, 16s, then give up
+//  			Retry: pulse.Backoff(time.Second, time.Minute, 5),
+//  		},
+//  		bindings...)
+//
+// If you would rather process messages in bulk (e.g. to insert them into a
+// database in a single transaction), ConsumeBatch passes messages to your
+// callback in batches of up to ConsumeOptions.BatchSize messages, and
+// acknowledges each batch with a single ack.
+//
+// To protect downstream services from bursts of messages, ConsumeOptions can
+// limit the rate at which messages are dispatched (see RateLimiter), and the
+// number of messages being processed at a time (see
+// ConsumeOptions.MaxInFlight). Messages are never dropped; they wait, and the
+// broker stops delivering once the prefetch limit is reached.
+//
+// If a downstream service is down, every message fails, and would be
+// redelivered over and over again. A queue can be paused (see PulseQueue.Pause
+// and PulseQueue.Resume) to avoid this, or ConsumeOptions.CircuitBreaker can
+// pause it automatically after a number of consecutive failures, and resume it
+// once a probe message succeeds again.
+//
+// The prefetch of a queue can be changed while it is being consumed (see
+// PulseQueue.SetPrefetch), or adjusted automatically within bounds, according
+// to how quickly messages are processed (see ConsumeOptions.AdaptivePrefetch).
+//
+// To run hot standby replicas of a consumer that must process messages in
+// order, consume a named queue with ConsumeOptions.SingleActiveConsumer: only
+// one replica receives messages at a time, and another takes over if it stops.
+// ConsumeOptions.Priority and ConsumeOptions.Exclusive give further control
+// over which consumer of a queue receives its messages.
+//
+// Named queues are classic, non-durable queues by default. Set
+// ConsumeOptions.QueueType to declare a durable quorum queue instead, or a
+// stream queue, which keeps messages after they are acknowledged, so that
+// they can be replayed from an earlier offset (see ConsumeOptions.StreamOffset).
+//
+// The bindings of a queue can also be changed while it is being consumed, with
+// PulseQueue.AddBinding and PulseQueue.RemoveBinding. Bindings of a named
+// queue that are no longer wanted, e.g. after a deployment that changed them,
+// are removed when the queue is consumed with
+// ConsumeOptions.ReconcileBindings, which lists the current bindings via the
+// RabbitMQ management API.
+//
+// Pulse Guardian deletes queues that grow too large, which cancels their
+// consumer. Register a callback with PulseQueue.OnError to learn why a queue
+// stopped being consumed (e.g. errors.Is(err, pulse.ErrQueueDeleted)), or
+// consume it with ConsumeOptions.Redeclare, to declare and bind the queue
+// again, and carry on consuming.
+//
+// Callbacks are not the only way to receive messages. Subscribe returns a
+// PulseQueue whose messages can be received from a go channel (see
+// PulseQueue.Messages), or iterated over with a for loop (see PulseQueue.All),
+// which is often more convenient in programs built around select loops.
+// Messages are then represented by the Message type, which carries the
+// unmarshaled payload together with the exchange, routing key and other
+// metadata of the message, and has methods to acknowledge it, without
+// exposing the underlying amqp types. ConsumeMessages passes such messages to
+// a Handler function, which returns an error instead of acknowledging the
+// message: nil acknowledges it, an error marked with Permanent rejects it, and
+// any other error requeues it, so there is no acknowledgement to forget.
+//
+// Behaviour shared by all of your callbacks, such as recovering from panics,
+// or logging, can be added with Middleware, either for every queue of a
+// connection (see Connection.Use) or for a single queue (see
+// ConsumeOptions.Middleware). For example, the Tracing middleware continues
+// OpenTelemetry traces propagated in the headers of messages sent with
+// Connection.Publish. The Timeout middleware only cancels the context passed
+// to handlers, so it can only time out slow Handler functions of queues
+// consumed via ConsumeMessages, which observe the context; callbacks of
+// Consume and ConsumeWithOptions do not receive it, and run to completion.
+//
 // Please note the Consume method will take care of connecting to the pulse
 // server (if no connection has yet been established), creating an AMQP
 // channel, creating or connecting to an existing queue, binding it to all the
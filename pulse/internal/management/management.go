@@ -0,0 +1,196 @@
+// Package management makes requests to the RabbitMQ management HTTP API. It
+// is shared by package pulse, which lists the bindings of a queue in order to
+// remove stale ones, and package pulse/admin, which exposes the API to users,
+// so that both authenticate, build requests and handle errors in the same
+// way.
+package management
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultHTTPClient is used by clients without an HTTPClient
+var DefaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Client makes requests to the management API at BaseURL, authenticating
+// with User and Password.
+type Client struct {
+	BaseURL    string
+	User       string
+	Password   string
+	HTTPClient *http.Client
+}
+
+// Binding is a binding of a queue (or exchange) to an exchange.
+type Binding struct {
+	// Source is the name of the exchange, which is empty for the default
+	// exchange
+	Source string `json:"source"`
+	// Destination is the name of the bound queue or exchange
+	Destination string `json:"destination"`
+	// DestinationType is "queue" or "exchange"
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+	// PropertiesKey identifies the binding among those with the same source
+	// and destination
+	PropertiesKey string `json:"properties_key"`
+	VHost         string `json:"vhost"`
+}
+
+// URLError is returned when a request cannot be created, since BaseURL is
+// invalid.
+type URLError struct {
+	BaseURL string
+	Err     error
+}
+
+func (e *URLError) Error() string {
+	return "Invalid management API url " + e.BaseURL + ": " + e.Err.Error()
+}
+
+func (e *URLError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectionError is returned when the management API cannot be reached.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return "Failed to query management API: " + e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the management API responds with a status
+// code other than 2xx.
+type StatusError struct {
+	Method     string
+	Path       string
+	Status     string
+	StatusCode int
+	// Reason is the reason given in the body of the response, if any
+	Reason string
+}
+
+func (e *StatusError) Error() string {
+	message := fmt.Sprintf("Management API request %v %v failed: %v", e.Method, e.Path, e.Status)
+	if e.Reason != "" {
+		message += ": " + e.Reason
+	}
+	return message
+}
+
+// AccessRefused returns true if the credentials were rejected, or lack the
+// required permissions.
+func (e *StatusError) AccessRefused() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// NotFound returns true if the requested resource does not exist.
+func (e *StatusError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// DecodeError is returned when the response of the management API cannot be
+// decoded.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "Failed to decode management API response: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// NewRequest returns a request to the management API resource with the given
+// path segments, which are escaped.
+func (c *Client) NewRequest(ctx context.Context, method string, path ...string) (*http.Request, error) {
+	segments := make([]string, len(path))
+	for i, segment := range path {
+		segments[i] = url.PathEscape(segment)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.BaseURL, "/")+"/api/"+strings.Join(segments, "/"), nil)
+	if err != nil {
+		return nil, &URLError{BaseURL: c.BaseURL, Err: err}
+	}
+	req.SetBasicAuth(c.User, c.Password)
+	return req, nil
+}
+
+// Do sends the request, and decodes the response into result, unless it is
+// nil.
+func (c *Client) Do(req *http.Request, result interface{}) error {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = DefaultHTTPClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return &ConnectionError{Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{
+			Method:     req.Method,
+			Path:       req.URL.EscapedPath(),
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Reason:     reason(resp.Body),
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+// Request makes a request to the management API resource with the given path
+// segments, which are escaped, and decodes the response into result, unless
+// it is nil.
+func (c *Client) Request(ctx context.Context, method string, result interface{}, path ...string) error {
+	req, err := c.NewRequest(ctx, method, path...)
+	if err != nil {
+		return err
+	}
+	return c.Do(req, result)
+}
+
+// QueueBindings lists the bindings of the given queue in the given vhost,
+// including its binding to the default exchange.
+func (c *Client) QueueBindings(ctx context.Context, vhost string, queue string) ([]Binding, error) {
+	bindings := []Binding{}
+	if err := c.Request(ctx, "GET", &bindings, "queues", vhost, queue, "bindings"); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// reason returns the reason given in the body of an error response of the
+// management API, or an empty string if there is none
+func reason(body io.Reader) string {
+	var response struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(body, 64*1024)).Decode(&response); err != nil {
+		return ""
+	}
+	return response.Reason
+}
@@ -0,0 +1,33 @@
+package management
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "not_authorised", "reason": "Login failed"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := &Client{BaseURL: server.URL, User: "user", Password: "wrong"}
+	_, err := client.QueueBindings(context.Background(), "/", "queue/user/name")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || !statusErr.AccessRefused() || statusErr.Reason != "Login failed" || statusErr.Path != "/api/queues/%2F/queue%2Fuser%2Fname/bindings" {
+		t.Fatalf("Expected access to be refused, but got %#v", err)
+	}
+	client.Password = "secret"
+	_, err = client.QueueBindings(context.Background(), "/", "queue/user/name")
+	if !errors.As(err, &statusErr) || !statusErr.NotFound() || statusErr.Reason != "" {
+		t.Errorf("Expected queue not to be found, but got %#v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package pulse
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RateLimiter is a token bucket that limits the rate at which messages are
+// dispatched. Tokens are added at a fixed rate, up to a maximum (the burst),
+// and each message dispatched takes a token, waiting for one if necessary.
+//
+// A RateLimiter can be shared by several queues, via ConsumeOptions.RateLimit
+// (or by all queues of a connection, via Connection.SetRateLimit), in which
+// case the limit applies to the queues combined.
+//
+// Use NewRateLimiter to create a RateLimiter; the zero value does not limit
+// the rate at all.
+type RateLimiter struct {
+	mu sync.Mutex
+	// rate is the number of tokens added per second
+	rate  float64
+	burst float64
+	// tokens is the number of tokens available at time last; it is negative
+	// if tokens have been reserved by waiting callers
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that allows perSecond messages per
+// second on average, and bursts of up to burst messages. The bucket starts
+// full. An error is returned if perSecond is not positive.
+func NewRateLimiter(perSecond float64, burst int) (*RateLimiter, error) {
+	if !(perSecond > 0) {
+		return nil, Error(nil, fmt.Sprintf("Invalid rate limit %v - must be positive", perSecond))
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}, nil
+}
+
+// Wait takes a token, waiting until one is available, or until ctx is done,
+// in which case the error of ctx is returned.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	// a RateLimiter that was not created by NewRateLimiter is unlimited
+	if !(l.rate > 0) {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// reserve a token, even if it is not yet available
+	l.tokens--
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// return the reserved token
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// SetRateLimit limits the rate at which messages are dispatched by all queues
+// subsequently consumed via the connection, combined. It applies in addition
+// to any ConsumeOptions.RateLimit of the individual queues.
+func (c *Connection) SetRateLimit(limiter *RateLimiter) {
+	c.rateLimit = limiter
+}
+
+// inFlight limits the number of unsettled deliveries of a queue, which are
+// tracked by delivery tag
+type inFlight struct {
+	max int
+	mu  sync.Mutex
+	// tags holds the delivery tags of the unsettled deliveries
+	tags map[uint64]struct{}
+	// settled is closed (and replaced) whenever deliveries are settled
+	settled chan struct{}
+}
+
+func newInFlight(max int) *inFlight {
+	return &inFlight{
+		max:     max,
+		tags:    map[uint64]struct{}{},
+		settled: make(chan struct{}),
+	}
+}
+
+// acquire waits until fewer than max deliveries are unsettled, and then
+// records the delivery with the given tag as unsettled. It returns the error
+// of ctx if ctx is done first.
+func (f *inFlight) acquire(ctx context.Context, tag uint64) error {
+	for {
+		f.mu.Lock()
+		if len(f.tags) < f.max {
+			f.tags[tag] = struct{}{}
+			f.mu.Unlock()
+			return nil
+		}
+		settled := f.settled
+		f.mu.Unlock()
+		select {
+		case <-settled:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release records the delivery with the given tag as settled, together with
+// all deliveries with lower tags if multiple is true
+func (f *inFlight) release(tag uint64, multiple bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if multiple {
+		for t := range f.tags {
+			if t <= tag {
+				delete(f.tags, t)
+			}
+		}
+	} else {
+		delete(f.tags, tag)
+	}
+	close(f.settled)
+	f.settled = make(chan struct{})
+}
+
+// wrap records when the delivery (or, for acks and nacks of multiple
+// deliveries, any earlier delivery) is settled.
+func (f *inFlight) wrap(d amqp.Delivery) amqp.Delivery {
+	d.Acknowledger = &inFlightAcknowledger{
+		Acknowledger: d.Acknowledger,
+		inFlight:     f,
+	}
+	return d
+}
+
+// inFlightAcknowledger releases deliveries from an inFlight limit when they
+// are settled
+type inFlightAcknowledger struct {
+	amqp.Acknowledger
+	inFlight *inFlight
+}
+
+func (a *inFlightAcknowledger) Ack(tag uint64, multiple bool) error {
+	defer a.inFlight.release(tag, multiple)
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *inFlightAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	defer a.inFlight.release(tag, multiple)
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *inFlightAcknowledger) Reject(tag uint64, requeue bool) error {
+	defer a.inFlight.release(tag, false)
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// throttle waits until the rate limits and in-flight limit of the
+// subscription allow the delivery to be dispatched. It returns false if the
+// queue stopped being consumed while waiting.
+func (sub *subscription) throttle(d amqp.Delivery) (amqp.Delivery, bool) {
+	if sub.rateLimits == nil && sub.inFlight == nil {
+		return d, true
+	}
+	ctx := sub.pulseQueue.state.ctx
+	for _, limiter := range sub.rateLimits {
+		if limiter.Wait(ctx) != nil {
+			return d, false
+		}
+	}
+	if sub.inFlight != nil {
+		if sub.inFlight.acquire(ctx, d.DeliveryTag) != nil {
+			return d, false
+		}
+		d = sub.inFlight.wrap(d)
+	}
+	return d, true
+}
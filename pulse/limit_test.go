@@ -0,0 +1,94 @@
+package pulse
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter, err := NewRateLimiter(100, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// a burst of 2, followed by 2 more at 10ms intervals
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("Expected rate limiter to delay messages beyond the burst, but 4 messages took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow, _ := NewRateLimiter(0.001, 1)
+	if err := slow.Wait(ctx); err != nil {
+		t.Errorf("Expected token to be available for first message, but got: %v", err)
+	}
+	if err := slow.Wait(ctx); err != context.Canceled {
+		t.Errorf("Expected waiting to stop when context is cancelled, but got: %v", err)
+	}
+}
+
+func TestZeroRateLimiter(t *testing.T) {
+	limiter := &RateLimiter{}
+	for i := 0; i < 3; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Expected zero value rate limiter not to limit, but got: %v", err)
+		}
+	}
+}
+
+func TestInvalidRateLimit(t *testing.T) {
+	for _, perSecond := range []float64{0, -1, math.NaN()} {
+		if limiter, err := NewRateLimiter(perSecond, 1); err == nil {
+			t.Errorf("Expected rate limit %v to be rejected, but got %#v", perSecond, limiter)
+		}
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	sub := &subscription{inFlight: newInFlight(2)}
+	sub.pulseQueue.state = newQueueState()
+	ack := &recordingAcknowledger{}
+	delivery := func(tag uint64) amqp.Delivery {
+		d, ok := sub.prepare(amqp.Delivery{Acknowledger: ack, DeliveryTag: tag})
+		if !ok {
+			t.Fatalf("Expected delivery %v to be dispatched", tag)
+		}
+		return d
+	}
+	d1 := delivery(1)
+	delivery(2)
+
+	dispatched := make(chan amqp.Delivery)
+	go func() {
+		dispatched <- delivery(3)
+	}()
+	select {
+	case <-dispatched:
+		t.Fatalf("Expected third delivery to wait for one of the first two to be settled")
+	case <-time.After(20 * time.Millisecond):
+	}
+	d1.Reject(false)
+	d3 := <-dispatched
+
+	// acknowledging multiple deliveries releases all of them
+	d3.Ack(true)
+	delivery(4)
+	delivery(5)
+	if len(ack.acks) != 1 || len(ack.rejects) != 1 {
+		t.Errorf("Expected acknowledgements to be passed on, but got %#v", ack)
+	}
+
+	sub.pulseQueue.state.cancel()
+	if _, ok := sub.prepare(amqp.Delivery{Acknowledger: ack, DeliveryTag: 6}); ok {
+		t.Errorf("Expected delivery not to be dispatched once the queue is closed")
+	}
+}
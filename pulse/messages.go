@@ -0,0 +1,368 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Message is a pulse message received from a queue. It carries the decoded
+// payload and metadata of the underlying AMQP delivery, together with
+// methods for acknowledging it, so that message handlers need not depend on
+// the AMQP library.
+//
+// Since all fields are exported, handlers can be tested by constructing a
+// Message directly, with an Acknowledger that records acknowledgements.
+type Message struct {
+	// Payload is the json payload of the message, unmarshaled into the
+	// object returned by NewPayloadObject of Binding
+	Payload interface{}
+	// Binding is the binding that matched the message
+	Binding Binding
+	// Exchange is the name of the exchange the message was published to
+	Exchange string
+	// RoutingKey is the routing key the message was published with
+	RoutingKey string
+	// Timestamp is the time the message was published, if set by the
+	// publisher
+	Timestamp time.Time
+	// Headers holds the AMQP headers of the message
+	Headers map[string]interface{}
+	// Redelivered is true if the message has been delivered before, but was
+	// not acknowledged
+	Redelivered bool
+	// Body is the raw (json) body of the message
+	Body            []byte
+	ContentType     string
+	ContentEncoding string
+	MessageID       string
+	CorrelationID   string
+	AppID           string
+	// Acknowledger is used by the Ack, Nack and Reject methods to settle the
+	// message
+	Acknowledger Acknowledger
+}
+
+// Acknowledger settles a message, by acknowledging it, negatively
+// acknowledging it, or rejecting it.
+type Acknowledger interface {
+	Ack() error
+	Nack(requeue bool) error
+	Reject(requeue bool) error
+}
+
+// Ack acknowledges the message, removing it from the queue.
+func (msg Message) Ack() error {
+	if msg.Acknowledger == nil {
+		return Error(nil, "Message has no acknowledger")
+	}
+	return msg.Acknowledger.Ack()
+}
+
+// Nack negatively acknowledges the message. If requeue is true, the message
+// will be delivered again (subject to the retry and dead letter policies of
+// the queue), otherwise it is dropped (or dead-lettered).
+func (msg Message) Nack(requeue bool) error {
+	if msg.Acknowledger == nil {
+		return Error(nil, "Message has no acknowledger")
+	}
+	return msg.Acknowledger.Nack(requeue)
+}
+
+// Reject rejects the message. It behaves like Nack.
+func (msg Message) Reject(requeue bool) error {
+	if msg.Acknowledger == nil {
+		return Error(nil, "Message has no acknowledger")
+	}
+	return msg.Acknowledger.Reject(requeue)
+}
+
+// deliveryAcknowledger settles a message via its AMQP delivery
+type deliveryAcknowledger struct {
+	delivery amqp.Delivery
+}
+
+func (a deliveryAcknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+func (a deliveryAcknowledger) Nack(requeue bool) error {
+	return a.delivery.Nack(false, requeue)
+}
+
+func (a deliveryAcknowledger) Reject(requeue bool) error {
+	return a.delivery.Reject(requeue)
+}
+
+// trackingAcknowledger records whether a message has been settled, so that
+// messages settled by a handler are not settled again
+type trackingAcknowledger struct {
+	Acknowledger
+	settled atomic.Bool
+}
+
+func (a *trackingAcknowledger) Ack() error {
+	a.settled.Store(true)
+	return a.Acknowledger.Ack()
+}
+
+func (a *trackingAcknowledger) Nack(requeue bool) error {
+	a.settled.Store(true)
+	return a.Acknowledger.Nack(requeue)
+}
+
+func (a *trackingAcknowledger) Reject(requeue bool) error {
+	a.settled.Store(true)
+	return a.Acknowledger.Reject(requeue)
+}
+
+// settlementTracker records whether a delivery has been settled, so that
+// deliveries settled by a callback are not settled again
+type settlementTracker struct {
+	amqp.Acknowledger
+	settled atomic.Bool
+}
+
+func (a *settlementTracker) Ack(tag uint64, multiple bool) error {
+	a.settled.Store(true)
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *settlementTracker) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.settled.Store(true)
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *settlementTracker) Reject(tag uint64, requeue bool) error {
+	a.settled.Store(true)
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// message converts a delivery into a Message. It returns false if the
+// delivery failed validation, and should not be dispatched (see match).
+func (sub *subscription) message(d amqp.Delivery) (Message, bool) {
+	binding, payload, ok := sub.match(d)
+	return Message{
+		Payload:         payload,
+		Binding:         binding,
+		Exchange:        d.Exchange,
+		RoutingKey:      d.RoutingKey,
+		Timestamp:       d.Timestamp,
+		Headers:         d.Headers,
+		Redelivered:     d.Redelivered,
+		Body:            d.Body,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		MessageID:       d.MessageId,
+		CorrelationID:   d.CorrelationId,
+		AppID:           d.AppId,
+		Acknowledger:    deliveryAcknowledger{delivery: d},
+	}, ok
+}
+
+// Handler processes messages of a queue consumed via ConsumeMessages. The
+// context is cancelled when the queue stops being consumed.
+//
+// Unless auto acknowledging, the message is settled according to the error
+// returned by the handler, if the handler has not settled it itself: if nil,
+// the message is acknowledged; if the error is permanent (see Permanent), the
+// message is rejected, or moved to the dead letter queue if there is one;
+// otherwise the message is nacked with requeue=true, and so redelivered
+// (subject to the retry and dead letter policies of the queue).
+type Handler func(ctx context.Context, msg Message) error
+
+// permanentError marks an error as permanent
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string {
+	return err.err.Error()
+}
+
+func (err permanentError) Unwrap() error {
+	return err.err
+}
+
+// Permanent marks err as permanent, meaning that processing the message
+// again will not succeed, so that a Handler returning it causes the message
+// to be rejected rather than redelivered. Permanent returns nil if err is
+// nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// IsPermanent reports whether err (or any error it wraps) was marked as
+// permanent by Permanent, or is a *DecodeError, since a message that cannot
+// be decoded will not be decodable when redelivered either.
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	var decodeErr *DecodeError
+	return errors.As(err, &permanent) || errors.As(err, &decodeErr)
+}
+
+// handler wraps handler with the middleware of the subscription
+func (sub *subscription) handler(handler Handler) Handler {
+	return chain(handler, sub.middleware...)
+}
+
+// ConsumeMessages behaves like ConsumeWithOptions, except that messages are
+// passed to handler as a Message, rather than as a payload and an AMQP
+// delivery, and are settled according to the error returned by handler (see
+// Handler), so that handlers need not remember to acknowledge them.
+func (c *Connection) ConsumeMessages(queueName string, handler Handler, options ConsumeOptions, bindings ...Binding) (PulseQueue, error) {
+	sub, err := c.newSubscription(queueName, options, bindings)
+	if err != nil {
+		return PulseQueue{}, err
+	}
+	go func() {
+		for i := range sub.deliveries {
+			i, ok := sub.prepare(i)
+			if !ok {
+				continue
+			}
+			msg, ok := sub.message(i)
+			if !ok {
+				continue
+			}
+			sub.handle(sub.pulseQueue.state.ctx, handler, i, msg)
+		}
+		if err := sub.pulseQueue.stopped(); err != nil {
+			log.Printf("Stopped consuming queue %v: %v", sub.pulseQueue.state.queue, err)
+		}
+	}()
+	return sub.pulseQueue, nil
+}
+
+// handle passes the message of delivery d to handler (wrapped in the
+// middleware of the subscription), and then settles it, unless the handler
+// settled it itself.
+func (sub *subscription) handle(ctx context.Context, handler Handler, d amqp.Delivery, msg Message) {
+	tracker := &trackingAcknowledger{Acknowledger: msg.Acknowledger}
+	msg.Acknowledger = tracker
+	err := sub.handler(handler)(ctx, msg)
+	if !sub.autoAck && !tracker.settled.Load() {
+		sub.settleMessage(d, err)
+	}
+}
+
+// settleMessage settles a delivery according to the error returned by the
+// handler that processed it (see Handler)
+func (sub *subscription) settleMessage(d amqp.Delivery, err error) {
+	switch {
+	case err == nil:
+		if ackErr := d.Ack(false); ackErr != nil {
+			log.Printf("Not able to ack message: %v", ackErr)
+		}
+	case IsPermanent(err):
+		log.Printf("Message with routing key %v from exchange %v failed permanently, rejecting: %v", d.RoutingKey, d.Exchange, err)
+		if deadLetters := sub.pulseQueue.deadLetters; deadLetters != nil {
+			if dlErr := deadLetters.route(d, err.Error()); dlErr != nil {
+				log.Printf("Not able to move message to dead letter queue: %v", dlErr)
+			}
+			return
+		}
+		if rejectErr := d.Reject(false); rejectErr != nil {
+			log.Printf("Not able to reject message: %v", rejectErr)
+		}
+	default:
+		log.Printf("Message with routing key %v from exchange %v failed, requeuing: %v", d.RoutingKey, d.Exchange, err)
+		if nackErr := d.Nack(false, true); nackErr != nil {
+			log.Printf("Not able to nack message: %v", nackErr)
+		}
+	}
+}
+
+// Subscribe behaves like ConsumeWithOptions, except that rather than passing
+// messages to a callback, it makes them available via the Messages and All
+// methods of the returned PulseQueue. This is convenient for processing
+// messages in select loops, or with a for loop:
+//
+//  	queue, err := conn.Subscribe("", pulse.ConsumeOptions{Prefetch: 10}, bindings...)
+//  	...
+//  	for msg, err := range queue.All(ctx) {
+//  		if err != nil {
+//  			...
+//  		}
+//  		...
+//  		msg.Ack()
+//  	}
+//
+// Messages are only read from the AMQP channel as fast as they are received
+// from Messages, and unless auto acknowledging, the server delivers no more
+// than options.Prefetch unacknowledged messages, so a slow reader does not
+// cause messages to accumulate in memory.
+func (c *Connection) Subscribe(queueName string, options ConsumeOptions, bindings ...Binding) (PulseQueue, error) {
+	sub, err := c.newSubscription(queueName, options, bindings)
+	if err != nil {
+		return PulseQueue{}, err
+	}
+	sub.pulseQueue.messages = make(chan Message)
+	go func() {
+		defer close(sub.pulseQueue.messages)
+		for i := range sub.deliveries {
+			i, ok := sub.prepare(i)
+			if !ok {
+				continue
+			}
+			msg, ok := sub.message(i)
+			if !ok {
+				continue
+			}
+			select {
+			case sub.pulseQueue.messages <- msg:
+			case <-sub.pulseQueue.state.ctx.Done():
+				return
+			}
+		}
+		sub.pulseQueue.stopped()
+	}()
+	return sub.pulseQueue, nil
+}
+
+// Messages returns the channel that messages of a queue consumed via
+// Subscribe are delivered on. The channel is closed when the queue stops
+// being consumed, after which Err reports the reason, if the queue was not
+// closed by calling Close. For queues consumed via a callback, Messages
+// returns nil.
+func (pq *PulseQueue) Messages() <-chan Message {
+	return pq.messages
+}
+
+// All returns an iterator over the messages of a queue consumed via
+// Subscribe. Iteration ends when the queue stops being consumed, or ctx is
+// done, in which case a final error is yielded, if the queue was not closed
+// by calling Close. Ending iteration does not close the queue.
+func (pq *PulseQueue) All(ctx context.Context) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		if pq.messages == nil {
+			yield(Message{}, Error(nil, "Queue was not consumed via Subscribe"))
+			return
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				yield(Message{}, ctx.Err())
+				return
+			case msg, ok := <-pq.messages:
+				if !ok {
+					if err := pq.Err(); err != nil {
+						yield(Message{}, err)
+					}
+					return
+				}
+				if !yield(msg, nil) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestAllMessages(t *testing.T) {
+	pq := PulseQueue{
+		messages: make(chan Message),
+		state:    newQueueState(),
+	}
+	go func() {
+		for i := 1; i <= 3; i++ {
+			pq.messages <- Message{MessageID: fmt.Sprint(i)}
+		}
+		pq.state.err = Error(&amqp.Error{Code: amqp.ConnectionForced}, "AMQP channel closed")
+		close(pq.messages)
+	}()
+	var ids []string
+	var finalErr error
+	for msg, err := range pq.All(context.Background()) {
+		if err != nil {
+			finalErr = err
+			continue
+		}
+		ids = append(ids, msg.MessageID)
+	}
+	if len(ids) != 3 || ids[0] != "1" || ids[2] != "3" {
+		t.Errorf("Expected messages 1, 2, 3 but got %v", ids)
+	}
+	var amqpErr *amqp.Error
+	if !errors.As(finalErr, &amqpErr) {
+		t.Errorf("Expected final error to report channel closure, but got %v", finalErr)
+	}
+}
+
+func TestAllMessagesCancelled(t *testing.T) {
+	pq := PulseQueue{
+		messages: make(chan Message),
+		state:    newQueueState(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, err := range pq.All(ctx) {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled but got %v", err)
+		}
+	}
+}
+
+func TestMessageFromDelivery(t *testing.T) {
+	typed := &typedBinding{rk: "*.*.gaia.#", en: "exchange/taskcluster-queue/v1/task-defined"}
+	sub := &subscription{pulseQueue: PulseQueue{bindings: newBindingSet(
+		Bind("*.*.aws-provisioner.#", "exchange/taskcluster-queue/v1/task-defined"),
+		typed,
+	)}}
+	ack := &recordingAcknowledger{}
+	msg, _ := sub.message(amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  4,
+		Exchange:     "exchange/taskcluster-queue/v1/task-defined",
+		RoutingKey:   "primary.abc.gaia.x",
+		Body:         []byte(`{"taskId": "abc"}`),
+	})
+	if msg.Binding != typed {
+		t.Errorf("Expected message to match binding %v but got %v", typed, msg.Binding)
+	}
+	if payload, ok := msg.Payload.(*taskDefined); !ok || payload.TaskID != "abc" {
+		t.Errorf("Expected payload to be unmarshaled using the matching binding, but got %#v", msg.Payload)
+	}
+	msg.Nack(true)
+	if len(ack.nacks) != 1 || ack.nacks[0] != 4 || !ack.requeued[0] {
+		t.Errorf("Expected Nack to nack the delivery, but got %#v", ack)
+	}
+}
+
+func TestHandlerErrorSettlesMessage(t *testing.T) {
+	sub := &subscription{pulseQueue: PulseQueue{bindings: newBindingSet(Bind("#", "exchange/test"))}}
+	handle := func(handler Handler) *recordingAcknowledger {
+		ack := &recordingAcknowledger{}
+		d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 5, Exchange: "exchange/test", Body: []byte(`{}`)}
+		msg, _ := sub.message(d)
+		sub.handle(context.Background(), handler, d, msg)
+		return ack
+	}
+	if ack := handle(func(ctx context.Context, msg Message) error { return nil }); len(ack.acks) != 1 {
+		t.Errorf("Expected nil error to ack message, but got %#v", ack)
+	}
+	if ack := handle(func(ctx context.Context, msg Message) error { return errors.New("unavailable") }); len(ack.nacks) != 1 || !ack.requeued[0] {
+		t.Errorf("Expected error to nack message with requeue, but got %#v", ack)
+	}
+	if ack := handle(func(ctx context.Context, msg Message) error { return Permanent(errors.New("invalid")) }); len(ack.rejects) != 1 || ack.requeued[0] {
+		t.Errorf("Expected permanent error to reject message, but got %#v", ack)
+	}
+	ack := handle(func(ctx context.Context, msg Message) error {
+		msg.Ack()
+		return errors.New("already acknowledged")
+	})
+	if len(ack.acks) != 1 || len(ack.nacks) != 0 {
+		t.Errorf("Expected message settled by handler not to be settled again, but got %#v", ack)
+	}
+	if !IsPermanent(fmt.Errorf("wrapped: %w", Permanent(errors.New("invalid")))) || IsPermanent(errors.New("unavailable")) || Permanent(nil) != nil {
+		t.Errorf("Unexpected classification of permanent errors")
+	}
+}
+
+// typedBinding is a Binding that unmarshals payloads into a taskDefined
+type typedBinding struct {
+	rk, en string
+}
+
+func (b *typedBinding) RoutingKey() string   { return b.rk }
+func (b *typedBinding) ExchangeName() string { return b.en }
+func (b *typedBinding) NewPayloadObject() interface{} {
+	return new(taskDefined)
+}
+
+type taskDefined struct {
+	TaskID string `json:"taskId"`
+}
@@ -0,0 +1,129 @@
+package pulse
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a Handler with cross-cutting behaviour, such as recovering
+// from panics, or logging. Middleware can be registered for all queues of a
+// connection with Connection.Use, or for a single queue with
+// ConsumeOptions.Middleware, and applies to messages consumed via Consume,
+// ConsumeWithOptions and ConsumeMessages. For example:
+//
+//  	conn := pulse.NewConnection("", "", "")
+//  	conn.Use(pulse.Recover(), pulse.Logging(nil))
+//  	conn.ConsumeMessages(
+//  		"taskprocessing",
+//  		handler,
+//  		pulse.ConsumeOptions{
+//  			Prefetch:   1,
+//  			Middleware: []pulse.Middleware{pulse.Timeout(time.Minute)},
+//  		},
+//  		bindings...,
+//  	)
+//
+// Middleware registered on the connection wraps middleware of the queue, and
+// the first middleware in a list is the outermost.
+type Middleware func(Handler) Handler
+
+// Use registers middleware that wraps the handlers (and callbacks) of all
+// queues subsequently consumed via the connection.
+func (c *Connection) Use(middleware ...Middleware) {
+	c.middleware = append(c.middleware, middleware...)
+}
+
+// chain wraps handler with the given middleware, the first of which is the
+// outermost
+func chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Recover returns middleware that recovers from panics in the handler, logs
+// them together with a stack trace, and returns the panic as an error instead
+// of crashing. Unless the message is auto acknowledged, or was already
+// settled before the panic, it is then nacked with requeue=true like any
+// other failed message (see Handler), and so is subject to the retry and
+// dead letter policies of the queue. Set ConsumeOptions.Retry or DeadLetter
+// so that a message that reliably causes a panic is not redelivered forever.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Recovered from panic handling message with routing key %v from exchange %v: %v\n%s", msg.RoutingKey, msg.Exchange, r, debug.Stack())
+					err = Error(nil, fmt.Sprintf("Panic handling message: %v", r))
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Timing returns middleware that calls observe with each message, and how
+// long the handler took to process it, e.g. to record metrics.
+func Timing(observe func(msg Message, duration time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			start := time.Now()
+			defer func() {
+				observe(msg, time.Since(start))
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Logging returns middleware that logs the receipt of each message, and how
+// long it took to process (and the error, if processing failed), to logger,
+// or to the default logger if logger is nil.
+func Logging(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			attrs := []interface{}{
+				slog.String("exchange", msg.Exchange),
+				slog.String("routingKey", msg.RoutingKey),
+			}
+			if msg.MessageID != "" {
+				attrs = append(attrs, slog.String("messageId", msg.MessageID))
+			}
+			logger.InfoContext(ctx, "Received message", attrs...)
+			start := time.Now()
+			err := next(ctx, msg)
+			attrs = append(attrs, slog.Duration("duration", time.Since(start)))
+			if err != nil {
+				logger.ErrorContext(ctx, "Failed to process message", append(attrs, slog.Any("error", err))...)
+				return err
+			}
+			logger.InfoContext(ctx, "Processed message", attrs...)
+			return nil
+		}
+	}
+}
+
+// Timeout returns middleware that cancels the context passed to the handler
+// once the handler has been processing a message for longer than timeout.
+// Handlers should observe the cancellation of the context, since they are
+// not otherwise interrupted. It therefore only affects handlers of queues
+// consumed via ConsumeMessages (and middleware further down the chain), since
+// Consume and ConsumeWithOptions callbacks, and consumers of Subscribe, do
+// not receive the context.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			ctx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("Message handler timed out after %v", timeout))
+			defer cancel()
+			return next(ctx, msg)
+		}
+	}
+}
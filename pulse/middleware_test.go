@@ -0,0 +1,97 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, msg Message) error {
+				calls = append(calls, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+	conn := NewConnection("", "", "amqp://localhost")
+	conn.Use(record("connection"))
+	sub := &subscription{
+		middleware: append(append([]Middleware{}, conn.middleware...), record("queue1"), record("queue2")),
+	}
+	sub.handler(func(ctx context.Context, msg Message) error {
+		calls = append(calls, "handler")
+		return nil
+	})(context.Background(), Message{})
+	expected := []string{"connection", "queue1", "queue2", "handler"}
+	if len(calls) != len(expected) {
+		t.Fatalf("Expected calls %v but got %v", expected, calls)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Fatalf("Expected calls %v but got %v", expected, calls)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	handle := func(autoAck bool, handler Handler) (*recordingAcknowledger, error) {
+		sub := &subscription{autoAck: autoAck, pulseQueue: PulseQueue{bindings: newBindingSet(Bind("#", "exchange/test"))}}
+		ack := &recordingAcknowledger{}
+		d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 2, Exchange: "exchange/test", Body: []byte(`{}`)}
+		msg, _ := sub.message(d)
+		var err error
+		sub.handle(context.Background(), chain(handler, func(next Handler) Handler {
+			return func(ctx context.Context, msg Message) error {
+				err = next(ctx, msg)
+				return err
+			}
+		}, Recover()), d, msg)
+		return ack, err
+	}
+	ack, err := handle(false, func(ctx context.Context, msg Message) error {
+		panic("boom")
+	})
+	if err == nil || IsPermanent(err) {
+		t.Errorf("Expected panic to be returned as a transient error, but got %v", err)
+	}
+	if len(ack.nacks) != 1 || !ack.requeued[0] {
+		t.Errorf("Expected panic to nack message with requeue, but got %#v", ack)
+	}
+	ack, _ = handle(true, func(ctx context.Context, msg Message) error {
+		panic("boom")
+	})
+	if len(ack.acks)+len(ack.nacks)+len(ack.rejects) != 0 {
+		t.Errorf("Expected auto acknowledged message not to be settled after panic, but got %#v", ack)
+	}
+	ack, _ = handle(false, func(ctx context.Context, msg Message) error {
+		msg.Ack()
+		panic("boom")
+	})
+	if len(ack.acks) != 1 || len(ack.nacks)+len(ack.rejects) != 0 {
+		t.Errorf("Expected message acknowledged before panic not to be settled again, but got %#v", ack)
+	}
+}
+
+func TestTimingAndTimeout(t *testing.T) {
+	var observed time.Duration
+	handler := chain(
+		func(ctx context.Context, msg Message) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		Timing(func(msg Message, duration time.Duration) { observed = duration }),
+		Timeout(10*time.Millisecond),
+	)
+	if err := handler(context.Background(), Message{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected handler to time out, but got %v", err)
+	}
+	if observed < 10*time.Millisecond {
+		t.Errorf("Expected handler to take at least 10ms, but took %v", observed)
+	}
+}
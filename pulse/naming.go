@@ -0,0 +1,150 @@
+package pulse
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	// DefaultQueuePrefix is the template for the prefix of queue names used
+	// if QueueNaming.Prefix is empty
+	DefaultQueuePrefix = "queue/{user}/"
+	// DefaultUnnamedQueue is the template for the names of unnamed queues
+	// used if QueueNaming.Unnamed is empty
+	DefaultUnnamedQueue = "{uuid}"
+	// MaxQueueNameLength is the maximum length of an AMQP queue name, in
+	// bytes
+	MaxQueueNameLength = 255
+)
+
+// QueueNaming determines the names of the queues declared by a Connection.
+// Names are given as templates, in which the following placeholders are
+// replaced:
+//
+//  	{user}      the pulse user of the connection
+//  	{hostname}  the hostname of the machine
+//  	{pod}       the value of environment variable POD_NAME, or if it is
+//  	            not set, the hostname (which kubernetes sets to the pod
+//  	            name)
+//  	{uuid}      a random UUID
+//
+// Pulse only allows users to declare queues whose names begin with
+// "queue/<user>/", so the prefix must expand to a name that does. For
+// example, to give each pod of a deployment its own queue, with a predictable
+// name for monitoring:
+//
+//  	conn.QueueNaming = pulse.QueueNaming{
+//  		Prefix:  "queue/{user}/my-service/",
+//  		Unnamed: "{pod}",
+//  	}
+//
+// Note that unnamed queues are exclusive to their connection, so a queue
+// named after a pod cannot be declared again until the previous connection
+// of the pod has closed.
+type QueueNaming struct {
+	// Prefix is the template for the prefix of the names of all queues. If
+	// empty, DefaultQueuePrefix is used.
+	Prefix string
+	// Unnamed is the template for the rest of the name of queues consumed
+	// without a name. If empty, DefaultUnnamedQueue is used.
+	Unnamed string
+}
+
+// placeholder matches the placeholders of queue name templates
+var placeholder = regexp.MustCompile(`{[^{}]*}`)
+
+// hostname returns the hostname of the machine
+var hostname = os.Hostname
+
+// expand replaces the placeholders of the given queue name template
+func (naming QueueNaming) expand(template string, user string) (string, error) {
+	var err error
+	expanded := placeholder.ReplaceAllStringFunc(template, func(p string) string {
+		switch p {
+		case "{user}":
+			return user
+		case "{uuid}":
+			return uuid.New()
+		case "{pod}":
+			if pod := os.Getenv("POD_NAME"); pod != "" {
+				return pod
+			}
+			fallthrough
+		case "{hostname}":
+			host, hostErr := hostname()
+			if hostErr != nil && err == nil {
+				err = Error(hostErr, "Failed to determine hostname for queue name template "+template)
+			}
+			return host
+		}
+		if err == nil {
+			err = opError("name queue", ErrInvalidQueueName, nil, fmt.Sprintf("Unknown placeholder %v in queue name template %q", p, template))
+		}
+		return p
+	})
+	return expanded, err
+}
+
+// QueueName returns the full name of the queue that Consume declares for the
+// given queue name, according to the QueueNaming of the connection. For an
+// unnamed queue (empty queueName), the name may differ on each call, if it
+// contains a {uuid} placeholder. An error of kind ErrInvalidQueueName is
+// returned if the name is too long, or not owned by the user of the
+// connection.
+func (c *Connection) QueueName(queueName string) (string, error) {
+	naming := c.QueueNaming
+	if naming.Prefix == "" {
+		naming.Prefix = DefaultQueuePrefix
+	}
+	if naming.Unnamed == "" {
+		naming.Unnamed = DefaultUnnamedQueue
+	}
+	prefix, err := naming.expand(naming.Prefix, c.User)
+	if err != nil {
+		return "", err
+	}
+	if queueName == "" {
+		queueName, err = naming.expand(naming.Unnamed, c.User)
+		if err != nil {
+			return "", err
+		}
+	}
+	name := prefix + queueName
+	owned := "queue/" + c.User + "/"
+	if !strings.HasPrefix(name, owned) || len(name) == len(owned) {
+		return "", opError("name queue", ErrInvalidQueueName, nil, fmt.Sprintf("Queue name %q is not of the form %q, as required by pulse", name, owned+"<name>"))
+	}
+	if err := validateQueueNameLength(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// validateQueueNames checks that the names of the retry and dead letter
+// queues of the given queue fit within MaxQueueNameLength
+func validateQueueNames(name string, options ConsumeOptions) error {
+	if options.DeadLetter != nil {
+		if err := validateQueueNameLength(name + "/dead-letter"); err != nil {
+			return err
+		}
+	}
+	if options.Retry != nil {
+		for retry := 0; retry < len(options.Retry.Delays); retry++ {
+			if err := validateQueueNameLength(name + "/retry/" + options.Retry.delay(retry).String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateQueueNameLength(name string) error {
+	if len(name) > MaxQueueNameLength {
+		return opError("name queue", ErrInvalidQueueName, nil, fmt.Sprintf("Queue name %q is %v bytes long, which exceeds the AMQP limit of %v bytes", name, len(name), MaxQueueNameLength))
+	}
+	return nil
+}
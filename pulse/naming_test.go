@@ -0,0 +1,76 @@
+package pulse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueName(t *testing.T) {
+	defer func(h func() (string, error)) { hostname = h }(hostname)
+	hostname = func() (string, error) { return "worker-7f9c", nil }
+	t.Setenv("POD_NAME", "")
+
+	for _, test := range []struct {
+		naming   QueueNaming
+		name     string
+		expected string
+	}{
+		{QueueNaming{}, "tasks", "queue/alice/tasks"},
+		{QueueNaming{Prefix: "queue/{user}/my-service/"}, "tasks", "queue/alice/my-service/tasks"},
+		{QueueNaming{Unnamed: "{hostname}"}, "", "queue/alice/worker-7f9c"},
+		{QueueNaming{Prefix: "queue/{user}/{pod}/"}, "tasks", "queue/alice/worker-7f9c/tasks"},
+	} {
+		c := Connection{User: "alice", QueueNaming: test.naming}
+		name, err := c.QueueName(test.name)
+		if err != nil || name != test.expected {
+			t.Errorf("Expected queue %q with %#v to be named %v, but got %q, %v", test.name, test.naming, test.expected, name, err)
+		}
+	}
+
+	t.Setenv("POD_NAME", "my-service-0")
+	c := Connection{User: "alice", QueueNaming: QueueNaming{Unnamed: "{pod}"}}
+	if name, _ := c.QueueName(""); name != "queue/alice/my-service-0" {
+		t.Errorf("Expected queue to be named after pod, but got %v", name)
+	}
+	c.QueueNaming = QueueNaming{}
+	first, _ := c.QueueName("")
+	second, _ := c.QueueName("")
+	if !strings.HasPrefix(first, "queue/alice/") || first == second {
+		t.Errorf("Expected unnamed queues to have random names, but got %v and %v", first, second)
+	}
+}
+
+func TestInvalidQueueName(t *testing.T) {
+	for _, test := range []struct {
+		naming QueueNaming
+		name   string
+	}{
+		// not owned by the user
+		{QueueNaming{Prefix: "queue/bob/"}, "tasks"},
+		{QueueNaming{Prefix: "tasks/{user}/"}, "tasks"},
+		{QueueNaming{Prefix: "queue/{user}"}, "tasks"},
+		// too long
+		{QueueNaming{}, strings.Repeat("x", 250)},
+		// unknown placeholder
+		{QueueNaming{Prefix: "queue/{user}/{region}/"}, "tasks"},
+	} {
+		c := Connection{User: "alice", QueueNaming: test.naming}
+		if name, err := c.QueueName(test.name); !errors.Is(err, ErrInvalidQueueName) {
+			t.Errorf("Expected queue %q with %#v to be invalid, but got %q, %v", test.name, test.naming, name, err)
+		}
+	}
+
+	// the names of retry and dead letter queues must also fit
+	name := "queue/alice/" + strings.Repeat("x", 235)
+	if err := validateQueueNames(name, ConsumeOptions{}); err != nil {
+		t.Errorf("Expected %v bytes to be a valid queue name, but got %v", len(name), err)
+	}
+	if err := validateQueueNames(name, ConsumeOptions{DeadLetter: &DeadLetterPolicy{}}); !errors.Is(err, ErrInvalidQueueName) {
+		t.Errorf("Expected dead letter queue name to be too long, but got %v", err)
+	}
+	if err := validateQueueNames(name, ConsumeOptions{Retry: &RetryPolicy{Delays: []time.Duration{time.Minute}}}); !errors.Is(err, ErrInvalidQueueName) {
+		t.Errorf("Expected retry queue name to be too long, but got %v", err)
+	}
+}
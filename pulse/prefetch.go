@@ -0,0 +1,160 @@
+package pulse
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DefaultAdjustInterval is how often adaptive prefetch is adjusted, if
+// AdaptivePrefetch.Interval is not set.
+const DefaultAdjustInterval = 10 * time.Second
+
+// AdaptivePrefetch describes how to adjust the prefetch of a queue at
+// runtime, based on how quickly messages are processed.
+//
+// Every Interval, the mean time taken to settle (acknowledge, nack or reject)
+// a message is measured. If it has risen by more than half since the previous
+// interval, processing is slowing down (e.g. a downstream service is
+// struggling), and the prefetch is halved. Otherwise, if at least as many
+// messages were settled as the prefetch allows to be outstanding, the
+// prefetch is limiting throughput, and it is increased by a quarter. The
+// prefetch always stays between Min and Max. While the circuit breaker of
+// the queue (see ConsumeOptions.CircuitBreaker) is open or half-open, the
+// prefetch is not adjusted.
+type AdaptivePrefetch struct {
+	// Min and Max bound the prefetch
+	Min int
+	Max int
+	// Interval is how often the prefetch is adjusted, and defaults to
+	// DefaultAdjustInterval
+	Interval time.Duration
+}
+
+// clamp returns prefetch, bounded by Min and Max
+func (a *AdaptivePrefetch) clamp(prefetch int) int {
+	if prefetch < a.Min {
+		return a.Min
+	}
+	if prefetch > a.Max {
+		return a.Max
+	}
+	return prefetch
+}
+
+// next returns the prefetch for the next interval, given the current
+// prefetch, the number of messages settled in the last interval, and the mean
+// time taken to settle them, in the last interval and in the one before.
+func (a *AdaptivePrefetch) next(prefetch, settled int, mean, previous time.Duration) int {
+	switch {
+	case settled == 0:
+		// idle, so nothing to learn
+	case previous > 0 && mean > previous*3/2:
+		prefetch = prefetch / 2
+	case settled >= prefetch:
+		prefetch += max(1, prefetch/4)
+	}
+	return a.clamp(prefetch)
+}
+
+// prefetchTuner measures how long messages of a queue take to be settled,
+// and adjusts the prefetch of the queue accordingly
+type prefetchTuner struct {
+	policy *AdaptivePrefetch
+	queue  PulseQueue
+	// breaker is the circuit breaker of the queue, if any, which sets the
+	// prefetch itself while it is open or half-open
+	breaker *circuitBreaker
+
+	mu      sync.Mutex
+	settled int
+	total   time.Duration
+	// previous is the mean time taken to settle a message in the previous
+	// interval
+	previous time.Duration
+}
+
+// wrap records how long the delivery takes to be settled
+func (t *prefetchTuner) wrap(d amqp.Delivery) amqp.Delivery {
+	d.Acknowledger = &timingAcknowledger{
+		Acknowledger: d.Acknowledger,
+		tuner:        t,
+		start:        time.Now(),
+	}
+	return d
+}
+
+func (t *prefetchTuner) record(duration time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.settled++
+	t.total += duration
+}
+
+// run adjusts the prefetch of the queue every interval, until the queue
+// stops being consumed
+func (t *prefetchTuner) run() {
+	interval := t.policy.Interval
+	if interval <= 0 {
+		interval = DefaultAdjustInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.adjust()
+		case <-t.queue.state.ctx.Done():
+			return
+		}
+	}
+}
+
+// adjust sets the prefetch of the queue for the next interval
+func (t *prefetchTuner) adjust() {
+	t.mu.Lock()
+	settled, mean, previous := t.settled, time.Duration(0), t.previous
+	if settled > 0 {
+		mean = t.total / time.Duration(settled)
+		t.previous = mean
+	}
+	t.settled, t.total = 0, 0
+	t.mu.Unlock()
+
+	if t.breaker != nil && t.breaker.tripped() {
+		// leave the probe prefetch of the circuit breaker alone
+		return
+	}
+	current := t.queue.Prefetch()
+	next := t.policy.next(current, settled, mean, previous)
+	if next == current {
+		return
+	}
+	if err := t.queue.SetPrefetch(next); err != nil {
+		log.Printf("Not able to adjust prefetch from %v to %v: %v", current, next, err)
+	}
+}
+
+// timingAcknowledger records how long a delivery took to be settled
+type timingAcknowledger struct {
+	amqp.Acknowledger
+	tuner *prefetchTuner
+	start time.Time
+}
+
+func (a *timingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.tuner.record(time.Since(a.start))
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *timingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.tuner.record(time.Since(a.start))
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *timingAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.tuner.record(time.Since(a.start))
+	return a.Acknowledger.Reject(tag, requeue)
+}
@@ -0,0 +1,72 @@
+package pulse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestAdaptivePrefetch(t *testing.T) {
+	policy := &AdaptivePrefetch{Min: 2, Max: 40}
+	for _, test := range []struct {
+		prefetch, settled int
+		mean, previous    time.Duration
+		expected          int
+	}{
+		// idle
+		{10, 0, 0, time.Second, 10},
+		// prefetch limits throughput
+		{10, 25, time.Second, time.Second, 12},
+		{3, 3, time.Second, 0, 4},
+		{40, 100, time.Second, time.Second, 40},
+		// prefetch is not limiting throughput
+		{10, 5, time.Second, time.Second, 10},
+		// processing slows down
+		{10, 25, 2 * time.Second, time.Second, 5},
+		{3, 25, 2 * time.Second, time.Second, 2},
+	} {
+		if next := policy.next(test.prefetch, test.settled, test.mean, test.previous); next != test.expected {
+			t.Errorf("Expected prefetch %v with %v messages settled in %v (previously %v) to become %v, but got %v", test.prefetch, test.settled, test.mean, test.previous, test.expected, next)
+		}
+	}
+}
+
+func TestPrefetchTunerMeasuresSettlement(t *testing.T) {
+	tuner := &prefetchTuner{policy: &AdaptivePrefetch{Min: 1, Max: 10}}
+	ack := &recordingAcknowledger{}
+	for tag := uint64(1); tag <= 3; tag++ {
+		d := tuner.wrap(amqp.Delivery{Acknowledger: ack, DeliveryTag: tag})
+		time.Sleep(time.Millisecond)
+		d.Ack(false)
+	}
+	if tuner.settled != 3 || tuner.total < 3*time.Millisecond {
+		t.Errorf("Expected 3 messages settled in at least 3ms, but got %v in %v", tuner.settled, tuner.total)
+	}
+	if len(ack.acks) != 3 {
+		t.Errorf("Expected acks to be passed on, but got %#v", ack)
+	}
+}
+
+func TestPrefetchTunerDefersToCircuitBreaker(t *testing.T) {
+	breaker := &circuitBreaker{state: breakerHalfOpen}
+	tuner := &prefetchTuner{
+		policy:  &AdaptivePrefetch{Min: 1, Max: 10},
+		queue:   PulseQueue{state: newQueueState(), ch: &fakeChannel{}},
+		breaker: breaker,
+	}
+	// while paused, the prefetch is recorded without touching the channel
+	tuner.queue.state.prefetch, tuner.queue.state.paused = 1, true
+	adjust := func() int {
+		tuner.settled, tuner.total = 5, 5*time.Millisecond
+		tuner.adjust()
+		return tuner.queue.Prefetch()
+	}
+	if prefetch := adjust(); prefetch != 1 {
+		t.Errorf("Expected prefetch not to be adjusted while circuit breaker is half-open, but got %v", prefetch)
+	}
+	breaker.state = breakerClosed
+	if prefetch := adjust(); prefetch != 2 {
+		t.Errorf("Expected prefetch to be adjusted once circuit breaker is closed, but got %v", prefetch)
+	}
+}
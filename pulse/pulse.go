@@ -1,12 +1,15 @@
 package pulse
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/streadway/amqp"
@@ -14,8 +17,13 @@ import (
 
 // Utility method used for checking an error condition, and failing with a given
 // error message if the error is not nil. msg should contain a description of
-// what activity could not be performed as required.
+// what activity could not be performed as required. Any credentials contained
+// in the message (such as AMQP urls containing a password) are redacted.
 func (err PulseError) Error() string {
+	return redact(err.message(), err.secrets...)
+}
+
+func (err PulseError) message() string {
 	msg := err.Message
 	lle := err.LowerLevelError
 	if msg != "" {
@@ -30,6 +38,18 @@ func (err PulseError) Error() string {
 	return "Unknown Pulse Library error has occurred! No information available! :D"
 }
 
+// Unwrap returns the lower-level error, so that errors.As can be used to
+// retrieve e.g. the underlying *amqp.Error.
+func (err PulseError) Unwrap() error {
+	return err.LowerLevelError
+}
+
+// Is reports whether target is the Kind of this error, so that callers can
+// write e.g. errors.Is(err, pulse.ErrAccessRefused).
+func (err PulseError) Is(target error) bool {
+	return err.Kind != nil && err.Kind == target
+}
+
 // Utility function for generating a PulseError
 func Error(err error, msg string) PulseError {
 	return PulseError{
@@ -43,22 +63,182 @@ func Error(err error, msg string) PulseError {
 type PulseError struct {
 	Message         string
 	LowerLevelError error
+	// Op is the operation that failed, e.g. "connect" or "declare exchange"
+	Op string
+	// Kind is one of the sentinel errors below (ErrConnection,
+	// ErrAccessRefused, ErrExchangeNotFound, ErrQueueDeclare, ErrQueueDeleted,
+	// ErrConsumerCancelled, ErrChannelClosed, ErrInvalidQueueName), or nil if
+	// the failure could not be classified
+	Kind error
+	// secrets are additional strings (e.g. the connection password) to be
+	// redacted from the error message
+	secrets []string
+}
+
+// Sentinel errors describing the kind of a PulseError. Use errors.Is to test
+// for them, e.g.
+//
+//  	if errors.Is(err, pulse.ErrAccessRefused) {
+//  		// bad credentials, or no permission for the requested resource
+//  	}
+var (
+	// ErrConnection is the kind of error returned when a connection to the
+	// AMQP server could not be established, or a channel could not be opened
+	ErrConnection = errors.New("pulse: connection failure")
+	// ErrAccessRefused is the kind of error returned when the AMQP server
+	// rejects the credentials, or refuses access to a resource (AMQP reply
+	// code 403)
+	ErrAccessRefused = errors.New("pulse: access refused")
+	// ErrExchangeNotFound is the kind of error returned when binding to an
+	// exchange that does not exist (AMQP reply code 404)
+	ErrExchangeNotFound = errors.New("pulse: exchange not found")
+	// ErrQueueDeclare is the kind of error returned when a queue could not be
+	// declared, e.g. because it already exists with different properties
+	ErrQueueDeclare = errors.New("pulse: queue declaration failed")
+	// ErrQueueDeleted is the kind of error reported when a queue stops being
+	// consumed because it was deleted, e.g. by Pulse Guardian, since it grew
+	// too large
+	ErrQueueDeleted = errors.New("pulse: queue deleted")
+	// ErrConsumerCancelled is the kind of error reported when the server
+	// cancels the consumer of a queue that still exists, e.g. when the node
+	// hosting a replicated queue fails
+	ErrConsumerCancelled = errors.New("pulse: consumer cancelled by server")
+	// ErrChannelClosed is the kind of error reported when the server closes
+	// the AMQP channel of a queue because of an error on the channel, e.g.
+	// acknowledging a message twice
+	ErrChannelClosed = errors.New("pulse: channel closed by server")
+	// ErrInvalidQueueName is the kind of error returned when the name of a
+	// queue is too long, or not owned by the pulse user (see QueueNaming)
+	ErrInvalidQueueName = errors.New("pulse: invalid queue name")
+)
+
+// opError generates a PulseError for the failed operation op, deriving its
+// Kind from the AMQP reply code of err where possible, and otherwise falling
+// back to kind.
+func opError(op string, kind error, err error, msg string) PulseError {
+	if amqpErr, ok := err.(*amqp.Error); ok {
+		switch amqpErr.Code {
+		case amqp.AccessRefused:
+			kind = ErrAccessRefused
+		case amqp.NotFound:
+			if op == "declare exchange" {
+				kind = ErrExchangeNotFound
+			}
+		}
+	}
+	return PulseError{
+		Message:         msg,
+		LowerLevelError: err,
+		Op:              op,
+		Kind:            kind,
+	}
 }
 
 // PulseQueue manages an underlying AMQP queue, and provides methods for
 // closing, deleting, pausing and resuming queues.
 type PulseQueue struct {
+	// ch is the AMQP channel the queue is consumed on
+	ch channel
+	// closed receives the error that caused ch to be closed, if it was not
+	// closed by calling Close
+	closed chan *amqp.Error
+	// cancelled receives the tag of the consumer of the queue if the server
+	// cancels it
+	cancelled chan string
+	// deadLetters is the dead letter queue of the queue, if any
+	deadLetters *deadLetterQueue
+	// publisher republishes messages to the retry and dead letter queues of
+	// the queue, if any
+	publisher *publisher
+	// messages receives the messages of a queue consumed via Subscribe
+	messages chan Message
+	// state holds the mutable state of the queue, shared by all copies of
+	// the PulseQueue
+	state *queueState
+	// bindings holds the bindings of the queue
+	bindings *bindingSet
+}
+
+// channel is the part of *amqp.Channel used for consuming a queue
+type channel interface {
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// queueState holds the mutable state of a PulseQueue
+type queueState struct {
+	mu sync.Mutex
+	// err is the reason the queue stopped being consumed, if it was not
+	// closed by calling Close
+	err error
+	// ctx is cancelled when the queue stops being consumed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// conn is the AMQP connection of the queue, and secrets the strings to
+	// be redacted from errors about the queue (see Connection.opError)
+	conn    *amqp.Connection
+	secrets []string
+	// queue is the name of the AMQP queue, and consumer the tag of its
+	// consumer, which is cancelled when the queue is paused
+	queue        string
+	consumer     string
+	autoAck      bool
+	exclusive    bool
+	consumerArgs amqp.Table
+	// stream is true for stream queues, whose consumer arguments are
+	// updated with the offset of each message received, in order that
+	// consumption continues from there when the queue is resumed
+	stream   bool
+	prefetch int
+	paused   bool
+	// userPaused is true if the queue was paused by calling Pause, rather
+	// than by the circuit breaker, and so is only resumed by calling Resume
+	userPaused bool
+	// consumers holds the deliveries of the consumers registered when the
+	// queue was resumed, which have not yet been forwarded by pump, and
+	// resumed is signalled when one is added
+	consumers []<-chan amqp.Delivery
+	resumed   chan struct{}
+	// onError is called with the reason the queue stopped being consumed, or
+	// its consumer was cancelled by the server (see OnError)
+	onError func(error)
+	// redeclare, if set, redeclares the queue and its bindings after the
+	// server cancelled its consumer (see ConsumeOptions.Redeclare), and
+	// recovering is true from when the cancellation is noticed until the
+	// queue has been redeclared, while the queue has no consumer
+	redeclare  func() error
+	recovering bool
+	// deleted reports whether the queue no longer exists
+	deleted func() bool
 }
 
 // Connection manages the underlying AMQP connection, and provides an interface
 // for performing further actions, such as creating a queue.
 type Connection struct {
-	User        string
-	Password    string
-	URL         string
+	User     string
+	Password string
+	URL      string
+	// ManagementURL is the base URL of the RabbitMQ management API (e.g.
+	// "https://pulse.mozilla.org"), which is used for reconciling bindings
+	// (see ConsumeOptions.ReconcileBindings). If empty, it is derived from
+	// URL, using the default management port of the server.
+	ManagementURL string
+	// QueueNaming determines the names of the queues declared by Consume.
+	// By default, queues are named "queue/<user>/<name>", and unnamed queues
+	// "queue/<user>/<uuid>".
+	QueueNaming QueueNaming
 	AMQPConn    *amqp.Connection
 	connected   bool
 	closedAlert chan amqp.Error
+	// middleware wraps the handlers of all queues consumed via the
+	// connection (see Use)
+	middleware []Middleware
+	// rateLimit limits the rate of all queues consumed via the connection
+	// (see SetRateLimit)
+	rateLimit *RateLimiter
 }
 
 // match applies the regular expression regex to string text, and only replaces
@@ -140,13 +320,29 @@ func NewConnection(pulseUser string, pulsePassword string, amqpUrl string) Conne
 		URL:      amqpUrl}
 }
 
+// opError generates a PulseError for a failed operation on this connection,
+// ensuring the connection password is redacted from the error message.
+func (c *Connection) opError(op string, kind error, err error, msg string) PulseError {
+	pulseErr := opError(op, kind, err, msg)
+	pulseErr.secrets = c.secrets()
+	return pulseErr
+}
+
+// opError generates a PulseError as opError does, redacting the secrets of
+// the connection of the queue
+func (pq *PulseQueue) opError(op string, kind error, err error, msg string) PulseError {
+	pulseErr := opError(op, kind, err, msg)
+	pulseErr.secrets = pq.state.secrets
+	return pulseErr
+}
+
 // connect is called internally, lazily, the first time Consume is called.
 // TODO: need to make sure this is properly synchronised.
 func (c *Connection) connect() error {
 	var err error
 	c.AMQPConn, err = amqp.Dial(c.URL)
 	if err != nil {
-		return Error(err, "Failed to connect to RabbitMQ")
+		return c.opError("connect", ErrConnection, err, "Failed to connect to RabbitMQ")
 	}
 	c.connected = true
 	return nil
@@ -155,7 +351,8 @@ func (c *Connection) connect() error {
 // Binding interface allows you to create custom types to describe exchange /
 // routing key combinations. For example Binding types are generated in Task
 // Cluster go client to avoid a library user referencing a non existent
-// exchange, or an invalid routing key.
+// exchange, or an invalid routing key. A Binding may additionally implement
+// FieldedBinding, to name the fields of the routing key.
 type Binding interface {
 
 	// This should return a routing key string for matching pulse messages
@@ -170,6 +367,25 @@ type Binding interface {
 	NewPayloadObject() interface{}
 }
 
+// findBinding returns binding if it implements T, or otherwise the first
+// binding it decorates that implements T. Bindings that decorate another
+// binding (such as those returned by WithCodec) provide it via an Unwrap()
+// Binding method.
+func findBinding[T any](binding Binding) (T, bool) {
+	for binding != nil {
+		if t, ok := binding.(T); ok {
+			return t, true
+		}
+		decorator, ok := binding.(interface{ Unwrap() Binding })
+		if !ok {
+			break
+		}
+		binding = decorator.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
 // Convenience private (unexported) type for binding a routing key/exchange
 // to a queue using plain strings for describing the exchange and routing key
 type simpleBinding struct {
@@ -207,6 +423,32 @@ func (s simpleBinding) NewPayloadObject() interface{} {
 	return new(interface{})
 }
 
+// matchesRoutingKey reports whether routingKey matches the topic exchange
+// pattern, in which '*' matches exactly one word, and '#' matches zero or more
+// words.
+func matchesRoutingKey(pattern, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
 // Consume is at the heart of the pulse library. After creating a connection
 // with pulse.NewConnection(...) above, you can call the Consume method to
 // register a queue, set a callback function to be called with each message
@@ -224,6 +466,9 @@ func (s simpleBinding) NewPayloadObject() interface{} {
 // auto-acknowledging, remember to ack / nack in your callback method.
 // bindings is a variadic input of the exchange names / routing keys that you
 // wish pulse to copy to your queue.
+//
+// See ConsumeWithOptions for further options, such as delayed retries of
+// failed messages.
 func (c *Connection) Consume(
 	queueName string,
 	callback func(interface{}, amqp.Delivery),
@@ -234,24 +479,295 @@ func (c *Connection) Consume(
 	PulseQueue,
 	error,
 ) {
-	pulseQueue := PulseQueue{}
+	return c.ConsumeWithOptions(
+		queueName,
+		callback,
+		ConsumeOptions{
+			Prefetch: prefetch,
+			AutoAck:  autoAck,
+		},
+		bindings...)
+}
+
+// ConsumeOptions holds the settings for consuming from a queue with
+// ConsumeWithOptions. The zero value is valid, and means a prefetch of 0 (no
+// limit) and manual acknowledgement of messages.
+type ConsumeOptions struct {
+	// Prefetch specifies how many messages should be read from the queue at
+	// a time
+	Prefetch int
+	// AutoAck specifies if auto acknowledgements should be sent or not; if
+	// not auto-acknowledging, remember to ack / nack in your callback method
+	AutoAck bool
+	// Retry, if set, causes messages that the callback nacks or rejects with
+	// requeue=true to be redelivered after a delay, rather than immediately.
+	// See RetryPolicy. Retry cannot be combined with AutoAck.
+	Retry *RetryPolicy
+	// DeadLetter, if set, causes messages that have been redelivered too
+	// many times to be moved to a dead letter queue, rather than being passed
+	// to the callback. See DeadLetterPolicy. DeadLetter cannot be combined
+	// with AutoAck.
+	DeadLetter *DeadLetterPolicy
+	// BatchSize is the maximum number of messages passed to the callback of
+	// ConsumeBatch at a time. It is only used by ConsumeBatch.
+	BatchSize int
+	// BatchWait is the maximum time ConsumeBatch waits for a batch to fill
+	// up before passing it to the callback. It is only used by ConsumeBatch,
+	// and defaults to DefaultBatchWait.
+	BatchWait time.Duration
+	// OnDecodeError, if set, is called with the details of every message
+	// that fails strict decoding or schema validation of a binding created
+	// by WithValidation, before the message is rejected (or moved to the
+	// dead letter queue, if DeadLetter is set). By default the error is
+	// logged.
+	OnDecodeError func(*DecodeError)
+	// Middleware wraps the callback (or handler) of the queue, inside any
+	// middleware registered on the connection with Use. See Middleware.
+	Middleware []Middleware
+	// RateLimit, if set, limits the rate at which messages are dispatched.
+	// Messages are not dropped, but wait to be dispatched, so that unless
+	// auto acknowledging, the broker also slows down once Prefetch messages
+	// are waiting. The limiter may be shared with other queues.
+	RateLimit *RateLimiter
+	// MaxInFlight, if positive, is the maximum number of messages that have
+	// been dispatched but not yet acknowledged (or nacked or rejected).
+	// Further messages wait until earlier ones are settled, which allows
+	// callbacks to process messages concurrently, e.g. in separate go
+	// routines, without overwhelming downstream services. MaxInFlight
+	// cannot be combined with AutoAck.
+	MaxInFlight int
+	// CircuitBreaker, if set, pauses the queue when messages keep failing,
+	// and resumes it once they succeed again. See CircuitBreakerPolicy.
+	// CircuitBreaker cannot be combined with AutoAck or SingleActiveConsumer.
+	CircuitBreaker *CircuitBreakerPolicy
+	// AdaptivePrefetch, if set, adjusts the prefetch at runtime, starting
+	// from Prefetch, according to how quickly messages are processed. See
+	// AdaptivePrefetch. AdaptivePrefetch cannot be combined with AutoAck or
+	// SingleActiveConsumer.
+	AdaptivePrefetch *AdaptivePrefetch
+	// Priority is the priority of the consumer (consumer argument
+	// "x-priority"). The server delivers messages to the consumers of a
+	// queue with the highest priority, as long as they are able to receive
+	// them (i.e. are within their prefetch), and only delivers to lower
+	// priority consumers when they are not.
+	Priority int
+	// SingleActiveConsumer declares a named queue with queue argument
+	// "x-single-active-consumer", so that only one of its consumers receives
+	// messages at a time, in order. If it stops consuming, another consumer
+	// takes over, which allows for hot standby replicas. Note that the server
+	// refuses to redeclare an existing queue with a different setting (see
+	// ErrQueueDeclare), so the queue must be deleted first in order to enable
+	// it on an existing queue. Since changing the prefetch of a queue (see
+	// SetPrefetch) or pausing it replaces its consumer, which hands over the
+	// active role to another consumer, SingleActiveConsumer cannot be
+	// combined with AdaptivePrefetch or CircuitBreaker.
+	SingleActiveConsumer bool
+	// Exclusive registers the consumer as the only consumer of the queue.
+	// Consuming from a queue that already has a consumer then fails, as does
+	// any other attempt to consume from the queue while it is consumed
+	// exclusively (see ErrAccessRefused).
+	Exclusive bool
+	// QueueType is the type of a named queue, and defaults to ClassicQueue.
+	// See QueueType. As for SingleActiveConsumer, the type of an existing
+	// queue cannot be changed.
+	QueueType QueueType
+	// DeliveryLimit, if positive, is the number of times a message of a
+	// quorum queue may be delivered before it is dropped (queue argument
+	// "x-delivery-limit").
+	DeliveryLimit int
+	// StreamOffset is the offset of a stream queue to start consuming from,
+	// and defaults to OffsetNext. When a paused stream queue is resumed,
+	// consumption continues after the last message received.
+	StreamOffset *StreamOffset
+	// ReconcileBindings, if set, removes any bindings of a named queue that
+	// were not passed to Consume, e.g. bindings left over from a previous
+	// deployment. The current bindings of the queue are listed using the
+	// RabbitMQ management API (see Connection.ManagementURL). Messages from
+	// exchanges the queue is no longer bound to, which are still in the
+	// queue, are rejected (rather than causing a panic).
+	ReconcileBindings bool
+	// Redeclare, if set, redeclares the queue, and binds it again, if the
+	// server cancels its consumer, e.g. because Pulse Guardian deleted the
+	// queue for growing too large, and then continues consuming it. The
+	// messages the queue held when it was deleted are lost. Without
+	// Redeclare, the queue stops being consumed (see PulseQueue.OnError).
+	Redeclare bool
+}
+
+// ConsumeWithOptions behaves like Consume, but takes its settings from
+// options, which allows for additional features such as delayed retries.
+func (c *Connection) ConsumeWithOptions(
+	queueName string,
+	callback func(interface{}, amqp.Delivery),
+	options ConsumeOptions,
+	bindings ...Binding,
+) (
+	PulseQueue,
+	error,
+) {
+	sub, err := c.newSubscription(queueName, options, bindings)
+	if err != nil {
+		return PulseQueue{}, err
+	}
+	go func() {
+		for i := range sub.deliveries {
+			i, ok := sub.prepare(i)
+			if !ok {
+				continue
+			}
+			if sub.middleware == nil {
+				payload, ok := sub.decode(i)
+				if !ok {
+					continue
+				}
+				callback(payload, i)
+				continue
+			}
+			tracker := &settlementTracker{Acknowledger: i.Acknowledger}
+			i.Acknowledger = tracker
+			msg, ok := sub.message(i)
+			if !ok {
+				continue
+			}
+			// callbacks settle messages themselves, but middleware can fail
+			// messages (e.g. Recover, after a panic) that the callback did
+			// not settle
+			err := sub.handler(func(ctx context.Context, msg Message) error {
+				callback(msg.Payload, i)
+				return nil
+			})(sub.pulseQueue.state.ctx, msg)
+			if err != nil && !sub.autoAck && !tracker.settled.Load() {
+				sub.settleMessage(i, err)
+			}
+		}
+		if err := sub.pulseQueue.stopped(); err != nil {
+			log.Printf("Stopped consuming queue %v: %v", sub.pulseQueue.state.queue, err)
+		}
+	}()
+	return sub.pulseQueue, nil
+}
+
+// subscription holds the state of a queue that is being consumed, which is
+// shared by the various ways of dispatching its messages
+type subscription struct {
+	pulseQueue    PulseQueue
+	ch            *amqp.Channel
+	deliveries    <-chan amqp.Delivery
+	retrier       *retrier
+	autoAck       bool
+	reconcile     bool
+	onDecodeError func(*DecodeError)
+	// middleware is the middleware of the connection followed by that of the
+	// queue, or nil if there is none
+	middleware []Middleware
+	rateLimits []*RateLimiter
+	inFlight   *inFlight
+	breaker    *circuitBreaker
+	tuner      *prefetchTuner
+}
+
+// newSubscription connects to pulse if not already connected, declares the
+// queue and binds it to the given bindings, and registers a consumer.
+func (c *Connection) newSubscription(queueName string, options ConsumeOptions, bindings []Binding) (*subscription, error) {
+	sub := &subscription{
+		autoAck:       options.AutoAck,
+		onDecodeError: options.OnDecodeError,
+	}
+	if len(c.middleware) > 0 || len(options.Middleware) > 0 {
+		sub.middleware = append(append([]Middleware{}, c.middleware...), options.Middleware...)
+	}
+
+	if options.Retry != nil && options.AutoAck {
+		return nil, Error(nil, "Retry policy cannot be used with auto-acknowledged messages")
+	}
+	if options.Retry != nil && len(options.Retry.Delays) == 0 && options.Retry.MaxAttempts > 1 {
+		return nil, Error(nil, "Retry policy needs at least one delay in order to retry messages")
+	}
+	if options.DeadLetter != nil && options.AutoAck {
+		return nil, Error(nil, "Dead letter policy cannot be used with auto-acknowledged messages")
+	}
+	if options.SingleActiveConsumer && queueName == "" {
+		return nil, Error(nil, "Single active consumer requires a named queue")
+	}
+	// changing the prefetch, or pausing, replaces the consumer, which would
+	// hand over the active role to a standby
+	if options.SingleActiveConsumer && options.AdaptivePrefetch != nil {
+		return nil, Error(nil, "Adaptive prefetch cannot be used with a single active consumer")
+	}
+	if options.SingleActiveConsumer && options.CircuitBreaker != nil {
+		return nil, Error(nil, "Circuit breaker cannot be used with a single active consumer")
+	}
+	if err := validateQueueType(queueName, options); err != nil {
+		return nil, err
+	}
+	if options.MaxInFlight > 0 && options.AutoAck {
+		return nil, Error(nil, "Maximum in-flight messages cannot be used with auto-acknowledged messages")
+	}
+	if options.CircuitBreaker != nil {
+		if options.AutoAck {
+			return nil, Error(nil, "Circuit breaker cannot be used with auto-acknowledged messages")
+		}
+		if options.CircuitBreaker.FailureThreshold < 1 {
+			return nil, Error(nil, fmt.Sprintf("Invalid circuit breaker failure threshold %v - must be at least 1", options.CircuitBreaker.FailureThreshold))
+		}
+	}
+	if adaptive := options.AdaptivePrefetch; adaptive != nil {
+		if options.AutoAck {
+			return nil, Error(nil, "Adaptive prefetch cannot be used with auto-acknowledged messages")
+		}
+		if adaptive.Min < 1 || adaptive.Max < adaptive.Min {
+			return nil, Error(nil, fmt.Sprintf("Invalid adaptive prefetch bounds %v - %v", adaptive.Min, adaptive.Max))
+		}
+		options.Prefetch = adaptive.clamp(options.Prefetch)
+	}
+	for _, limiter := range []*RateLimiter{c.rateLimit, options.RateLimit} {
+		if limiter != nil {
+			sub.rateLimits = append(sub.rateLimits, limiter)
+		}
+	}
+	if options.MaxInFlight > 0 {
+		sub.inFlight = newInFlight(options.MaxInFlight)
+	}
+	name, err := c.QueueName(queueName)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateQueueNames(name, options); err != nil {
+		return nil, err
+	}
 
 	// TODO: this needs to be synchronised
 	if !c.connected {
-		c.connect()
+		err := c.connect()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ch, err := c.AMQPConn.Channel()
 	if err != nil {
-		return pulseQueue, Error(err, "Failed to open a channel")
+		return nil, c.opError("open channel", ErrConnection, err, "Failed to open a channel")
 	}
+	sub.ch = ch
+	sub.pulseQueue.ch = ch
+	sub.pulseQueue.closed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	// the server blocks until the tag is received, so leave room for more
+	// than one consumer being cancelled before pump notices
+	sub.pulseQueue.cancelled = ch.NotifyCancel(make(chan string, 4))
+	sub.pulseQueue.state = newQueueState()
 
-	// keep a map from exchange name to exchange object, so later we can
-	// unmarshal pulse messages into correct object from the exchange name
-	// in the amqp.Delivery object to get back to Binding, and thus to
-	// Binding.NewPayloadObject()
-	bindingLookup := make(map[string]Binding, len(bindings))
+	if options.Prefetch > 0 {
+		err = ch.Qos(
+			options.Prefetch, // prefetch count
+			0,                // prefetch size
+			false,            // global
+		)
+		if err != nil {
+			return nil, c.opError("set prefetch", nil, err, "Failed to set prefetch")
+		}
+	}
 
+	sub.pulseQueue.bindings = newBindingSet()
 	for i := range bindings {
 		err = ch.ExchangeDeclarePassive(
 			bindings[i].ExchangeName(), // name
@@ -263,36 +779,39 @@ func (c *Connection) Consume(
 			nil,                        // arguments
 		)
 		if err != nil {
-			return pulseQueue, Error(err, "Failed to passively declare exchange "+bindings[i].ExchangeName())
+			return nil, c.opError("declare exchange", nil, err, "Failed to passively declare exchange "+bindings[i].ExchangeName())
 		}
 		// bookkeeping...
-		bindingLookup[bindings[i].ExchangeName()] = bindings[i]
-	}
-
-	var q amqp.Queue
-	if queueName == "" {
-		q, err = ch.QueueDeclare(
-			"queue/"+c.User+"/"+uuid.New(), // name
-			false, // durable
-			// unnamed queues get deleted when disconnected
-			true, // delete when usused
-			// unnamed queues are exclusive
-			true,  // exclusive
-			false, // no-wait
-			nil,   // arguments
-		)
-	} else {
-		q, err = ch.QueueDeclare(
-			"queue/"+c.User+"/"+queueName, // name
-			false, // durable
-			false, // delete when usused
-			false, // exclusive
-			false, // no-wait
-			nil,   // arguments
-		)
+		sub.pulseQueue.bindings.add(bindings[i])
 	}
+
+	q, err := declareQueue(ch, name, queueName == "", options)
 	if err != nil {
-		return pulseQueue, Error(err, "Failed to declare queue")
+		return nil, c.opError("declare queue", ErrQueueDeclare, err, "Failed to declare queue")
+	}
+
+	if options.DeadLetter != nil {
+		sub.pulseQueue.deadLetters, err = c.declareDeadLetterQueue(ch, q.Name, queueName == "", options.DeadLetter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Retry != nil {
+		sub.retrier, err = c.declareRetryQueues(ch, q.Name, queueName == "", options.Retry)
+		if err != nil {
+			return nil, err
+		}
+		sub.retrier.deadLetters = sub.pulseQueue.deadLetters
+	}
+	if options.DeadLetter != nil || options.Retry != nil {
+		sub.pulseQueue.publisher = newPublisher(c.AMQPConn)
+		if sub.pulseQueue.deadLetters != nil {
+			sub.pulseQueue.deadLetters.publisher = sub.pulseQueue.publisher
+		}
+		if sub.retrier != nil {
+			sub.retrier.publisher = sub.pulseQueue.publisher
+		}
 	}
 
 	for i := range bindings {
@@ -304,54 +823,439 @@ func (c *Connection) Consume(
 			false,
 			nil)
 		if err != nil {
-			return pulseQueue, Error(err, "Failed to bind a queue")
+			return nil, c.opError("bind queue", nil, err, "Failed to bind a queue")
 		}
 	}
 
-	eventsChan, err := ch.Consume(
-		q.Name,  // queue
-		"",      // consumer
-		autoAck, // auto ack
-		false,   // exclusive
-		false,   // no local
-		false,   // no wait
-		nil,     // args
-	)
+	if options.ReconcileBindings && queueName != "" {
+		err = c.reconcileBindings(ch, q.Name, bindings)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sub.reconcile = options.ReconcileBindings
+
+	state := sub.pulseQueue.state
+	state.conn = c.AMQPConn
+	state.secrets = c.secrets()
+	state.queue = q.Name
+	state.consumer = "consumer/" + uuid.New()
+	state.autoAck = options.AutoAck
+	state.exclusive = options.Exclusive
+	state.consumerArgs = consumerArguments(options)
+	state.stream = options.QueueType == StreamQueue
+	state.prefetch = options.Prefetch
+	state.deleted = func() bool {
+		return queueDeleted(c.AMQPConn, q.Name)
+	}
+	if options.Redeclare {
+		state.redeclare = func() error {
+			return c.redeclareQueue(ch, q.Name, queueName == "", options, sub.pulseQueue.bindings)
+		}
+	}
+	if options.CircuitBreaker != nil {
+		sub.breaker = newCircuitBreaker(options.CircuitBreaker, sub.pulseQueue)
+	}
+	if options.AdaptivePrefetch != nil {
+		sub.tuner = &prefetchTuner{
+			policy:  options.AdaptivePrefetch,
+			queue:   sub.pulseQueue,
+			breaker: sub.breaker,
+		}
+	}
+	deliveries, err := sub.pulseQueue.consume()
 	if err != nil {
-		return pulseQueue, Error(err, "Failed to register a consumer")
+		return nil, c.opError("consume", nil, err, "Failed to register a consumer")
+	}
+	out := make(chan amqp.Delivery)
+	sub.deliveries = out
+	go sub.pulseQueue.pump(deliveries, out)
+	if sub.tuner != nil {
+		go sub.tuner.run()
 	}
 
-	go func() {
-		for i := range eventsChan {
-			payload := i.Body
-			binding, ok := bindingLookup[i.Exchange]
-			if !ok {
-				panic(errors.New(fmt.Sprintf("ERROR: Message received for an unknown exchange '%v' - not sure how to process", i.Exchange)))
+	return sub, nil
+}
+
+// consume registers the consumer of the queue
+func (pq *PulseQueue) consume() (<-chan amqp.Delivery, error) {
+	return pq.ch.Consume(
+		pq.state.queue,        // queue
+		pq.state.consumer,     // consumer
+		pq.state.autoAck,      // auto ack
+		pq.state.exclusive,    // exclusive
+		false,                 // no local
+		false,                 // no wait
+		pq.state.consumerArgs, // args
+	)
+}
+
+// queueArguments returns the arguments for declaring a named queue with the
+// given options
+func queueArguments(options ConsumeOptions) amqp.Table {
+	args := amqp.Table{}
+	if options.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if options.QueueType != "" {
+		args["x-queue-type"] = string(options.QueueType)
+	}
+	if options.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = int32(options.DeliveryLimit)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// consumerArguments returns the arguments for registering a consumer with
+// the given options
+func consumerArguments(options ConsumeOptions) amqp.Table {
+	args := amqp.Table{}
+	if options.Priority != 0 {
+		args["x-priority"] = int32(options.Priority)
+	}
+	if options.StreamOffset != nil {
+		args["x-stream-offset"] = options.StreamOffset.value
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// advanceStreamOffset records the offset of a delivery from a stream queue,
+// so that a new consumer continues from the following message
+func (pq *PulseQueue) advanceStreamOffset(d amqp.Delivery) {
+	offset, ok := streamOffset(d)
+	if !ok {
+		return
+	}
+	pq.state.mu.Lock()
+	defer pq.state.mu.Unlock()
+	args := amqp.Table{}
+	for key, value := range pq.state.consumerArgs {
+		args[key] = value
+	}
+	args["x-stream-offset"] = offset + 1
+	pq.state.consumerArgs = args
+}
+
+// pump forwards deliveries to out, switching to the deliveries of the new
+// consumer each time the queue is resumed after being paused, until the
+// queue stops being consumed.
+func (pq *PulseQueue) pump(deliveries <-chan amqp.Delivery, out chan<- amqp.Delivery) {
+	defer close(out)
+	closed := pq.ch.NotifyClose(make(chan *amqp.Error, 1))
+	for deliveries != nil {
+		for d := range deliveries {
+			if pq.state.stream {
+				pq.advanceStreamOffset(d)
 			}
-			payloadObject := binding.NewPayloadObject()
-			err := json.Unmarshal(payload, payloadObject)
-			if err != nil {
-				fmt.Printf("Unable to unmarshal json payload into object:\nPayload:\n%v\nObject: %T\n", string(payload), payloadObject)
+			select {
+			case out <- d:
+			case <-pq.state.ctx.Done():
+				return
 			}
-			callback(payloadObject, i)
 		}
-		fmt.Println("AMQP channel closed - has the connection dropped?")
-	}()
-	return pulseQueue, nil
+		if pq.consumerCancelled() {
+			deliveries = pq.recover(closed)
+			continue
+		}
+		deliveries = pq.waitForResume(closed)
+	}
 }
 
-// TODO: not yet implemented
-func (pq *PulseQueue) Pause() {
+// waitForResume waits for the queue to be resumed if it has been paused, and
+// returns the deliveries of the next consumer, or nil if the queue stopped
+// being consumed.
+func (pq *PulseQueue) waitForResume(closed <-chan *amqp.Error) <-chan amqp.Delivery {
+	for {
+		pq.state.mu.Lock()
+		if len(pq.state.consumers) > 0 {
+			deliveries := pq.state.consumers[0]
+			pq.state.consumers = pq.state.consumers[1:]
+			pq.state.mu.Unlock()
+			return deliveries
+		}
+		paused := pq.state.paused
+		pq.state.mu.Unlock()
+		if !paused {
+			return nil
+		}
+		select {
+		case <-pq.state.resumed:
+		case <-closed:
+			return nil
+		case <-pq.state.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// prepare applies the retry and dead letter policies of the subscription to
+// a delivery, and then waits for its rate and in-flight limits. It returns
+// false if the delivery has already been taken care of, or the queue stopped
+// being consumed, and the delivery should not be dispatched.
+func (sub *subscription) prepare(d amqp.Delivery) (amqp.Delivery, bool) {
+	d = restoreOrigin(d)
+	if deadLetters := sub.pulseQueue.deadLetters; deadLetters != nil {
+		handled, err := deadLetters.check(d)
+		if err != nil {
+			log.Printf("Failed to handle redelivered message: %v", err)
+		}
+		if handled {
+			return d, false
+		}
+		if sub.retrier == nil {
+			d = deadLetters.wrap(d)
+		}
+	}
+	if sub.retrier != nil {
+		d = sub.retrier.wrap(d)
+	}
+	if sub.breaker != nil {
+		d = sub.breaker.wrap(d)
+	}
+	if sub.tuner != nil {
+		d = sub.tuner.wrap(d)
+	}
+	return sub.throttle(d)
+}
+
+// decode unmarshals the json payload of a delivery into a new payload object
+// of the binding that the delivery matched. It returns false if the delivery
+// failed validation, and should not be dispatched (see match).
+func (sub *subscription) decode(d amqp.Delivery) (interface{}, bool) {
+	_, payloadObject, ok := sub.match(d)
+	return payloadObject, ok
+}
+
+// match returns the binding that the delivery matched, and the payload of
+// the delivery decoded (see Codec) into a new payload object of that binding.
+// If several bindings match, the first is returned. If no bindings match the
+// routing key, the first binding for the exchange is used.
+//
+// If the binding validates its messages (see WithValidation) and the
+// delivery is invalid, the delivery is taken care of by rejecting it (see
+// ConsumeOptions.OnDecodeError), and false is returned. The same applies to
+// deliveries from exchanges the queue is no longer bound to, if bindings are
+// reconciled (see ConsumeOptions.ReconcileBindings).
+func (sub *subscription) match(d amqp.Delivery) (Binding, interface{}, bool) {
+	candidates, ok := sub.pulseQueue.bindings.forExchange(d.Exchange)
+	if !ok && sub.reconcile {
+		log.Printf("Rejecting message with routing key %v from exchange %v, which the queue is no longer bound to", d.RoutingKey, d.Exchange)
+		if !sub.autoAck {
+			if err := d.Reject(false); err != nil {
+				log.Printf("Not able to reject message: %v", err)
+			}
+		}
+		return nil, nil, false
+	}
+	if !ok {
+		panic(errors.New(fmt.Sprintf("ERROR: Message received for an unknown exchange '%v' - not sure how to process", d.Exchange)))
+	}
+	binding := candidates[0]
+	for _, candidate := range candidates {
+		if matchesRoutingKey(candidate.RoutingKey(), d.RoutingKey) {
+			binding = candidate
+			break
+		}
+	}
+	payloadObject, err := decodePayload(binding, d)
+	if err != nil {
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			sub.invalid(d, decodeErr)
+			return binding, payloadObject, false
+		}
+		fmt.Printf("Unable to decode payload into object:\nPayload:\n%v\nObject: %T\nError: %v\n", string(d.Body), payloadObject, err)
+	}
+	return binding, payloadObject, true
+}
+
+// Pause stops the server delivering messages of the queue, by cancelling its
+// consumer, until Resume is called. Messages that have already been delivered
+// (up to the prefetch limit) are still dispatched. The queue continues to
+// receive messages from its bindings while paused.
+func (pq *PulseQueue) Pause() error {
+	if pq.ch == nil {
+		return Error(nil, "Queue is not being consumed")
+	}
+	pq.state.mu.Lock()
+	defer pq.state.mu.Unlock()
+	if err := pq.pause(); err != nil {
+		return err
+	}
+	pq.state.userPaused = true
+	return nil
+}
+
+// pause cancels the consumer of the queue. The caller must hold the lock of
+// the queue state.
+func (pq *PulseQueue) pause() error {
+	if pq.state.paused {
+		return nil
+	}
+	// mark the queue as paused before cancelling the consumer, so that the
+	// end of its deliveries is not mistaken for the end of the queue
+	pq.state.paused = true
+	if pq.state.recovering {
+		// the server has already cancelled the consumer
+		return nil
+	}
+	err := pq.ch.Cancel(pq.state.consumer, false)
+	if err != nil {
+		pq.state.paused = false
+		return Error(err, "Failed to pause queue")
+	}
+	return nil
 }
 
 // TODO: not yet implemented
 func (pq *PulseQueue) Delete() {
 }
 
-// TODO: not yet implemented
-func (pq *PulseQueue) Resume() {
+// Resume resumes consuming from a queue that was paused by calling Pause.
+func (pq *PulseQueue) Resume() error {
+	if pq.ch == nil {
+		return Error(nil, "Queue is not being consumed")
+	}
+	pq.state.mu.Lock()
+	defer pq.state.mu.Unlock()
+	if err := pq.resume(pq.state.prefetch); err != nil {
+		return err
+	}
+	pq.state.userPaused = false
+	return nil
 }
 
-// TODO: not yet implemented
-func (pq *PulseQueue) Close() {
+// resume registers a new consumer for a paused queue, with the given
+// prefetch. The caller must hold the lock of the queue state.
+func (pq *PulseQueue) resume(prefetch int) error {
+	if !pq.state.paused {
+		return nil
+	}
+	// the prefetch applies to consumers registered afterwards
+	err := pq.ch.Qos(
+		prefetch, // prefetch count
+		0,        // prefetch size
+		false,    // global
+	)
+	if err != nil {
+		return Error(err, "Failed to set prefetch")
+	}
+	if pq.state.recovering {
+		// a consumer is registered once the queue has been redeclared
+		pq.state.paused = false
+		return nil
+	}
+	deliveries, err := pq.consume()
+	if err != nil {
+		return Error(err, "Failed to resume queue")
+	}
+	pq.state.paused = false
+	pq.state.consumers = append(pq.state.consumers, deliveries)
+	select {
+	case pq.state.resumed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetPrefetch changes how many messages the server delivers to the queue
+// before they are acknowledged. Since the server only applies a new prefetch
+// to new consumers, the consumer of the queue is replaced; messages that have
+// already been delivered are unaffected. If the queue is paused, the new
+// prefetch applies once it is resumed.
+func (pq *PulseQueue) SetPrefetch(prefetch int) error {
+	if pq.ch == nil {
+		return Error(nil, "Queue is not being consumed")
+	}
+	if prefetch < 0 {
+		return Error(nil, fmt.Sprintf("Invalid prefetch %v - must not be negative", prefetch))
+	}
+	pq.state.mu.Lock()
+	defer pq.state.mu.Unlock()
+	if pq.state.prefetch == prefetch {
+		return nil
+	}
+	pq.state.prefetch = prefetch
+	if pq.state.paused {
+		return nil
+	}
+	if err := pq.pause(); err != nil {
+		return err
+	}
+	return pq.resume(prefetch)
+}
+
+// Prefetch returns the prefetch of the queue (see SetPrefetch).
+func (pq *PulseQueue) Prefetch() int {
+	if pq.state == nil {
+		return 0
+	}
+	pq.state.mu.Lock()
+	defer pq.state.mu.Unlock()
+	return pq.state.prefetch
+}
+
+// newQueueState returns the initial state of a queue
+func newQueueState() *queueState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &queueState{
+		ctx:     ctx,
+		cancel:  cancel,
+		resumed: make(chan struct{}, 1),
+	}
+}
+
+// Err returns the error that caused the queue to stop being consumed, e.g.
+// because the connection dropped. It returns nil while the queue is being
+// consumed, and after the queue has been closed by calling Close.
+func (pq *PulseQueue) Err() error {
+	if pq.state == nil {
+		return nil
+	}
+	pq.state.mu.Lock()
+	defer pq.state.mu.Unlock()
+	return pq.state.err
+}
+
+// stopped records why the queue stopped being consumed, once its deliveries
+// have ended, and returns it
+func (pq *PulseQueue) stopped() error {
+	defer pq.state.cancel()
+	defer pq.publisher.close()
+	pq.state.mu.Lock()
+	err := pq.state.err
+	pq.state.mu.Unlock()
+	if err != nil {
+		// the consumer was cancelled by the server, so the channel is still
+		// open
+		pq.ch.Close()
+		return err
+	}
+	amqpErr := <-pq.closed
+	if amqpErr == nil {
+		return nil
+	}
+	return pq.fail(closeError(amqpErr))
+}
+
+// Close stops consuming from the queue, by closing its AMQP channel. Unnamed
+// queues are deleted by the server once closed. Any messages that have been
+// delivered but not yet acknowledged are returned to the queue.
+func (pq *PulseQueue) Close() error {
+	if pq.ch == nil {
+		return Error(nil, "Queue is not being consumed")
+	}
+	pq.state.cancel()
+	pq.publisher.close()
+	err := pq.ch.Close()
+	if err != nil {
+		return Error(err, "Failed to close AMQP channel")
+	}
+	return nil
 }
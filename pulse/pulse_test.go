@@ -0,0 +1,104 @@
+package pulse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestErrorKinds(t *testing.T) {
+	testKind := func(op string, kind error, lowerLevel error, expected error) {
+		err := error(opError(op, kind, lowerLevel, "Failed to "+op))
+		if expected != nil && !errors.Is(err, expected) {
+			t.Errorf("Expected %v to be of kind %v", err, expected)
+		}
+		var amqpErr *amqp.Error
+		if _, isAMQP := lowerLevel.(*amqp.Error); isAMQP && !errors.As(err, &amqpErr) {
+			t.Errorf("Expected to unwrap *amqp.Error from %v", err)
+		}
+	}
+	testKind("connect", ErrConnection, errors.New("dial tcp: connection refused"), ErrConnection)
+	testKind("connect", ErrConnection, amqp.ErrCredentials, ErrAccessRefused)
+	testKind("declare exchange", nil, &amqp.Error{Code: amqp.NotFound}, ErrExchangeNotFound)
+	testKind("declare exchange", nil, &amqp.Error{Code: amqp.AccessRefused}, ErrAccessRefused)
+	testKind("declare queue", ErrQueueDeclare, &amqp.Error{Code: amqp.PreconditionFailed}, ErrQueueDeclare)
+	testKind("declare queue", ErrQueueDeclare, &amqp.Error{Code: amqp.AccessRefused}, ErrAccessRefused)
+
+	err := error(opError("bind queue", nil, &amqp.Error{Code: amqp.NotFound}, "Failed to bind a queue"))
+	if errors.Is(err, ErrExchangeNotFound) || errors.Is(err, ErrAccessRefused) {
+		t.Errorf("Did not expect %v to be classified", err)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	conn := NewConnection("pmoore_test1", "donkey123", "amqps://localhost:5671")
+	outputs := []string{
+		fmt.Sprintf("%v", conn),
+		fmt.Sprintf("%+v", conn),
+		fmt.Sprintf("%#v", conn),
+		fmt.Sprintf("%v", &conn),
+		conn.opError("connect", ErrConnection, errors.New("dial "+conn.URL+" failed using password donkey123"), "Failed to connect to RabbitMQ").Error(),
+		(&PulseQueue{state: &queueState{secrets: conn.secrets()}}).opError("bind queue", nil, errors.New("password donkey123 refused"), "Failed to bind a queue").Error(),
+		Error(errors.New("cannot connect to amqp://a:b@c:5671"), "Failed").Error(),
+	}
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("connecting", "conn", conn)
+	outputs = append(outputs, buf.String())
+	for _, output := range outputs {
+		if strings.Contains(output, "donkey123") || strings.Contains(output, ":b@") {
+			t.Errorf("Password leaked in %q", output)
+		}
+		if !strings.Contains(output, redacted) {
+			t.Errorf("Expected redaction placeholder in %q", output)
+		}
+	}
+}
+
+func TestMatchesRoutingKey(t *testing.T) {
+	testMatch := func(pattern, routingKey string, expected bool) {
+		if matchesRoutingKey(pattern, routingKey) != expected {
+			t.Errorf("Expected matchesRoutingKey(%q, %q) to be %v", pattern, routingKey, expected)
+		}
+	}
+	testMatch("#", "a.b.c", true)
+	testMatch("#", "", true)
+	testMatch("*", "a", true)
+	testMatch("*", "a.b", false)
+	testMatch("a.*.c", "a.b.c", true)
+	testMatch("a.*.c", "a.b.d", false)
+	testMatch("*.*.*.*.*.null-provisioner.buildbot-try.#", "primary.t1.0.wg.w1.null-provisioner.buildbot-try._", true)
+	testMatch("*.*.*.*.*.null-provisioner.buildbot-try.#", "primary.t1.0.wg.w1.null-provisioner.buildbot-try", true)
+	testMatch("*.*.*.*.*.null-provisioner.buildbot-try.#", "primary.t1.0.wg.w1.aws-provisioner.buildbot-try", false)
+	testMatch("a.#.d", "a.d", true)
+	testMatch("a.#.d", "a.b.c.d", true)
+	testMatch("a.#.d", "a.b.c", false)
+}
+
+func TestConsumeArguments(t *testing.T) {
+	if queueArguments(ConsumeOptions{}) != nil || consumerArguments(ConsumeOptions{}) != nil {
+		t.Errorf("Expected no arguments by default")
+	}
+	if args := queueArguments(ConsumeOptions{SingleActiveConsumer: true}); args["x-single-active-consumer"] != true {
+		t.Errorf("Expected single active consumer queue argument, but got %#v", args)
+	}
+	if args := consumerArguments(ConsumeOptions{Priority: 10}); args["x-priority"] != int32(10) {
+		t.Errorf("Expected consumer priority argument, but got %#v", args)
+	}
+	conn := NewConnection("", "", "amqp://localhost")
+	if _, err := conn.ConsumeWithOptions("", nil, ConsumeOptions{SingleActiveConsumer: true}); err == nil {
+		t.Errorf("Expected error consuming anonymous queue with single active consumer")
+	}
+	for _, options := range []ConsumeOptions{
+		{SingleActiveConsumer: true, AdaptivePrefetch: &AdaptivePrefetch{Min: 1, Max: 10}},
+		{SingleActiveConsumer: true, CircuitBreaker: &CircuitBreakerPolicy{FailureThreshold: 1}},
+	} {
+		if _, err := conn.ConsumeWithOptions("tasks", nil, options); err == nil || !strings.Contains(err.Error(), "single active consumer") {
+			t.Errorf("Expected error consuming queue with single active consumer and %#v, but got %v", options, err)
+		}
+	}
+}
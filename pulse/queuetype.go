@@ -0,0 +1,98 @@
+package pulse
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// QueueType is the type of a named queue (queue argument "x-queue-type").
+type QueueType string
+
+const (
+	// ClassicQueue is the default queue type. Named classic queues are not
+	// durable, so they do not survive a restart of the server.
+	ClassicQueue QueueType = "classic"
+	// QuorumQueue is a durable, replicated queue, which survives the loss of
+	// a server node. Quorum queues count how often each message has been
+	// delivered, and can drop (or dead-letter) messages delivered more than
+	// ConsumeOptions.DeliveryLimit times.
+	QuorumQueue QueueType = "quorum"
+	// StreamQueue is a durable, replicated, append-only log. Messages are not
+	// removed when acknowledged, so a consumer can read them from any offset
+	// (see ConsumeOptions.StreamOffset), e.g. to replay the messages of the
+	// last hour after a bug fix. Stream queues require a prefetch, and
+	// cannot be combined with AutoAck, Retry or DeadLetter.
+	StreamQueue QueueType = "stream"
+)
+
+// StreamOffset is the position in a stream queue to start consuming from.
+type StreamOffset struct {
+	value interface{}
+}
+
+var (
+	// OffsetFirst starts consuming from the first message in the stream
+	OffsetFirst = StreamOffset{value: "first"}
+	// OffsetLast starts consuming from the last chunk of messages in the
+	// stream
+	OffsetLast = StreamOffset{value: "last"}
+	// OffsetNext starts consuming from the next message appended to the
+	// stream. This is the default.
+	OffsetNext = StreamOffset{value: "next"}
+)
+
+// Offset starts consuming from the message with the given numeric offset.
+func Offset(offset int64) StreamOffset {
+	return StreamOffset{value: offset}
+}
+
+// OffsetTimestamp starts consuming from the messages appended to the stream
+// at or after the given time. For example, to replay the last hour:
+//
+//  	pulse.OffsetTimestamp(time.Now().Add(-time.Hour))
+func OffsetTimestamp(t time.Time) StreamOffset {
+	return StreamOffset{value: t}
+}
+
+// validateQueueType checks that the queue type options are consistent
+func validateQueueType(queueName string, options ConsumeOptions) error {
+	switch options.QueueType {
+	case "", ClassicQueue:
+	case QuorumQueue:
+	case StreamQueue:
+		switch {
+		case options.AutoAck:
+			return Error(nil, "Stream queues cannot be used with auto-acknowledged messages")
+		case options.Prefetch < 1 && options.AdaptivePrefetch == nil:
+			return Error(nil, "Stream queues require a prefetch")
+		case options.Retry != nil || options.DeadLetter != nil:
+			return Error(nil, "Stream queues cannot be used with retry or dead letter policies")
+		}
+	default:
+		return Error(nil, fmt.Sprintf("Unknown queue type %q", options.QueueType))
+	}
+	if options.QueueType != "" && options.QueueType != ClassicQueue && queueName == "" {
+		return Error(nil, fmt.Sprintf("Queues of type %v must be named", options.QueueType))
+	}
+	if options.DeliveryLimit > 0 && options.QueueType != QuorumQueue {
+		return Error(nil, "Delivery limit requires a quorum queue")
+	}
+	if options.StreamOffset != nil && options.QueueType != StreamQueue {
+		return Error(nil, "Stream offset requires a stream queue")
+	}
+	return nil
+}
+
+// durable reports whether a named queue with the given options is durable
+func durable(options ConsumeOptions) bool {
+	return options.QueueType == QuorumQueue || options.QueueType == StreamQueue
+}
+
+// streamOffset returns the offset of a delivery from a stream queue, and
+// whether it has one
+func streamOffset(d amqp.Delivery) (int64, bool) {
+	offset, ok := d.Headers["x-stream-offset"].(int64)
+	return offset, ok
+}
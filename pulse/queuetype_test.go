@@ -0,0 +1,57 @@
+package pulse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestQueueTypeArguments(t *testing.T) {
+	args := queueArguments(ConsumeOptions{QueueType: QuorumQueue, DeliveryLimit: 5})
+	if args["x-queue-type"] != "quorum" || args["x-delivery-limit"] != int32(5) {
+		t.Errorf("Unexpected quorum queue arguments %#v", args)
+	}
+	if !durable(ConsumeOptions{QueueType: StreamQueue}) || durable(ConsumeOptions{}) {
+		t.Errorf("Expected only quorum and stream queues to be durable")
+	}
+	since := time.Now().Add(-time.Hour)
+	offset := OffsetTimestamp(since)
+	args = consumerArguments(ConsumeOptions{QueueType: StreamQueue, StreamOffset: &offset})
+	if args["x-stream-offset"] != since {
+		t.Errorf("Unexpected stream consumer arguments %#v", args)
+	}
+
+	for _, invalid := range []struct {
+		queueName string
+		options   ConsumeOptions
+	}{
+		{"", ConsumeOptions{QueueType: QuorumQueue}},
+		{"events", ConsumeOptions{QueueType: "lazy"}},
+		{"events", ConsumeOptions{QueueType: StreamQueue}},
+		{"events", ConsumeOptions{QueueType: StreamQueue, Prefetch: 10, AutoAck: true}},
+		{"events", ConsumeOptions{QueueType: StreamQueue, Prefetch: 10, DeadLetter: &DeadLetterPolicy{}}},
+		{"events", ConsumeOptions{DeliveryLimit: 3}},
+		{"events", ConsumeOptions{StreamOffset: &OffsetFirst}},
+	} {
+		if validateQueueType(invalid.queueName, invalid.options) == nil {
+			t.Errorf("Expected error for queue %q with options %#v", invalid.queueName, invalid.options)
+		}
+	}
+	if err := validateQueueType("events", ConsumeOptions{QueueType: StreamQueue, Prefetch: 10, StreamOffset: &OffsetFirst}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestStreamOffsetAdvances(t *testing.T) {
+	pq := PulseQueue{state: newQueueState()}
+	pq.state.consumerArgs = amqp.Table{"x-priority": int32(1), "x-stream-offset": "first"}
+	initial := pq.state.consumerArgs
+	pq.advanceStreamOffset(amqp.Delivery{Headers: amqp.Table{"x-stream-offset": int64(41)}})
+	if pq.state.consumerArgs["x-stream-offset"] != int64(42) || pq.state.consumerArgs["x-priority"] != int32(1) {
+		t.Errorf("Expected consumption to resume from offset 42, but got %#v", pq.state.consumerArgs)
+	}
+	if initial["x-stream-offset"] != "first" {
+		t.Errorf("Expected previous consumer arguments to be unchanged")
+	}
+}
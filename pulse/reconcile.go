@@ -0,0 +1,108 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/streadway/amqp"
+	"github.com/taskcluster/pulse-go/pulse/internal/management"
+)
+
+// ManagementAPI returns the base URL of the RabbitMQ management API of the
+// connection (see Connection.ManagementURL), and the vhost of the connection,
+// which most management API resources are scoped to.
+func (c *Connection) ManagementAPI() (baseURL string, vhost string, err error) {
+	uri, err := amqp.ParseURI(c.URL)
+	if err != nil {
+		return "", "", Error(err, "Invalid AMQP url "+redact(c.URL, c.secrets()...))
+	}
+	if c.ManagementURL != "" {
+		return strings.TrimRight(c.ManagementURL, "/"), uri.Vhost, nil
+	}
+	scheme, port := "http", 15672
+	if uri.Scheme == "amqps" {
+		scheme, port = "https", 15671
+	}
+	return scheme + "://" + uri.Host + ":" + strconv.Itoa(port), uri.Vhost, nil
+}
+
+// queueBindings lists the bindings of the given queue via the RabbitMQ
+// management API
+func (c *Connection) queueBindings(queue string) ([]management.Binding, error) {
+	base, vhost, err := c.ManagementAPI()
+	if err != nil {
+		return nil, err
+	}
+	client := &management.Client{BaseURL: base, User: c.User, Password: c.Password}
+	bindings, err := client.QueueBindings(context.Background(), vhost, queue)
+	var (
+		urlErr    *management.URLError
+		statusErr *management.StatusError
+		decodeErr *management.DecodeError
+	)
+	switch {
+	case err == nil:
+		return bindings, nil
+	case errors.As(err, &urlErr):
+		return nil, Error(urlErr.Err, "Invalid management API url "+base)
+	case errors.As(err, &statusErr):
+		pulseErr := c.opError("list bindings", nil, nil, fmt.Sprintf("Failed to list bindings of queue %v: management API returned %v", queue, statusErr.Status))
+		if statusErr.AccessRefused() {
+			pulseErr.Kind = ErrAccessRefused
+		}
+		return nil, pulseErr
+	case errors.As(err, &decodeErr):
+		return nil, Error(decodeErr.Err, "Failed to decode bindings of queue "+queue)
+	}
+	return nil, c.opError("list bindings", ErrConnection, errors.Unwrap(err), "Failed to query management API")
+}
+
+// staleBindings returns the exchange bindings in current that are neither in
+// desired, nor from one of the exchanges in keep
+func staleBindings(current []management.Binding, desired []Binding, keep ...string) []management.Binding {
+	wanted := map[[2]string]bool{}
+	for _, binding := range desired {
+		wanted[[2]string{binding.ExchangeName(), binding.RoutingKey()}] = true
+	}
+	for _, exchange := range keep {
+		wanted[[2]string{exchange, ""}] = true
+	}
+	stale := []management.Binding{}
+	for _, binding := range current {
+		// every queue is bound to the default exchange
+		if binding.Source == "" || binding.DestinationType != "queue" {
+			continue
+		}
+		if wanted[[2]string{binding.Source, binding.RoutingKey}] || wanted[[2]string{binding.Source, ""}] {
+			continue
+		}
+		stale = append(stale, binding)
+	}
+	return stale
+}
+
+// reconcileBindings removes the bindings of the given queue that are not in
+// bindings, apart from those to the retry and dead letter exchanges of the
+// connection.
+func (c *Connection) reconcileBindings(ch *amqp.Channel, queue string, bindings []Binding) error {
+	current, err := c.queueBindings(queue)
+	if err != nil {
+		return err
+	}
+	for _, binding := range staleBindings(current, bindings, "exchange/"+c.User+"/retry", "exchange/"+c.User+"/dead-letter") {
+		err = ch.QueueUnbind(
+			queue,                         // queue name
+			binding.RoutingKey,            // routing key
+			binding.Source,                // exchange
+			amqp.Table(binding.Arguments)) // arguments
+		if err != nil {
+			return c.opError("unbind queue", nil, err, "Failed to remove stale binding to exchange "+binding.Source)
+		}
+		log.Printf("Removed stale binding of queue %v to exchange %v with routing key %v", queue, binding.Source, binding.RoutingKey)
+	}
+	return nil
+}
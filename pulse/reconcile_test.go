@@ -0,0 +1,68 @@
+package pulse
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/taskcluster/pulse-go/pulse/internal/management"
+)
+
+func TestManagementAPI(t *testing.T) {
+	for _, test := range []struct {
+		url, managementURL string
+		base, vhost        string
+	}{
+		{"amqps://pulse.mozilla.org:5671", "", "https://pulse.mozilla.org:15671", "/"},
+		{"amqp://localhost:5672/test", "", "http://localhost:15672", "test"},
+		{"amqps://pulse.mozilla.org:5671", "https://pulse.mozilla.org", "https://pulse.mozilla.org", "/"},
+	} {
+		c := Connection{URL: test.url, ManagementURL: test.managementURL}
+		base, vhost, err := c.ManagementAPI()
+		if err != nil || base != test.base || vhost != test.vhost {
+			t.Errorf("Expected %v to have management API %v and vhost %v, but got %v, %v, %v", test.url, test.base, test.vhost, base, vhost, err)
+		}
+	}
+}
+
+func TestQueueBindings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.EscapedPath() != "/api/queues/%2F/queue%2Fuser%2Fname/bindings" {
+			t.Errorf("Unexpected request path %v", r.URL.EscapedPath())
+		}
+		w.Write([]byte(`[
+			{"source": "", "routing_key": "queue/user/name", "destination_type": "queue"},
+			{"source": "exchange/a", "routing_key": "#", "destination_type": "queue"}
+		]`))
+	}))
+	defer server.Close()
+
+	c := Connection{User: "user", Password: "secret", URL: "amqp://localhost:5672", ManagementURL: server.URL}
+	bindings, err := c.queueBindings("queue/user/name")
+	if err != nil || len(bindings) != 2 || bindings[1].Source != "exchange/a" {
+		t.Fatalf("Expected two bindings, but got %#v, %v", bindings, err)
+	}
+	c.Password = "wrong"
+	if _, err := c.queueBindings("queue/user/name"); !errors.Is(err, ErrAccessRefused) {
+		t.Errorf("Expected access to be refused, but got %v", err)
+	}
+}
+
+func TestStaleBindings(t *testing.T) {
+	current := []management.Binding{
+		{Source: "", RoutingKey: "queue/user/name", DestinationType: "queue"},
+		{Source: "exchange/a", RoutingKey: "#", DestinationType: "queue"},
+		{Source: "exchange/a", RoutingKey: "old.#", DestinationType: "queue"},
+		{Source: "exchange/b", RoutingKey: "#", DestinationType: "queue"},
+		{Source: "exchange/user/retry", RoutingKey: "queue/user/name", DestinationType: "queue"},
+	}
+	stale := staleBindings(current, []Binding{Bind("#", "exchange/a")}, "exchange/user/retry")
+	if len(stale) != 2 || stale[0].RoutingKey != "old.#" || stale[1].Source != "exchange/b" {
+		t.Errorf("Expected old routing key and unwanted exchange to be stale, but got %#v", stale)
+	}
+}
@@ -0,0 +1,429 @@
+package pulse
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers used for tracking retried messages. Since a retried message is
+// redelivered from the retry exchange rather than the exchange it was
+// originally published to, the original exchange and routing key are
+// recorded, and restored before the message is passed to the callback.
+const (
+	headerRetries            = "x-pulse-retries"
+	headerOriginalExchange   = "x-pulse-original-exchange"
+	headerOriginalRoutingKey = "x-pulse-original-routing-key"
+)
+
+// RetryPolicy describes how failed messages should be retried. A message is
+// considered to have failed when the callback nacks or rejects it with
+// requeue=true. Rather than being requeued immediately (which typically
+// results in a hot loop of redeliveries), the message is published to a
+// retry queue, where it waits until its delay has elapsed, before being
+// dead-lettered back to the consumed queue.
+//
+// For each distinct delay, a retry queue named "<queue>/retry/<delay>" is
+// declared with a message TTL of the given delay. The retry queues, and the
+// consumed queue, are bound to exchange "exchange/<user>/retry", which is
+// created if it does not already exist.
+//
+// The number of retries is tracked in header "x-pulse-retries" of the
+// message. After MaxAttempts deliveries, the message is moved to the dead
+// letter queue if ConsumeOptions.DeadLetter is set, or otherwise rejected
+// without requeue, i.e. dropped.
+type RetryPolicy struct {
+	// Delays holds the delay before each retry. If there are more retries
+	// than delays, the last delay is used for all remaining retries. Delays
+	// must not be empty if MaxAttempts is greater than 1.
+	Delays []time.Duration
+	// MaxAttempts is the maximum number of times a message is delivered,
+	// including the first delivery. If zero, one attempt per delay is made,
+	// in addition to the first delivery.
+	MaxAttempts int
+}
+
+// Backoff returns a RetryPolicy that retries failed messages up to retries
+// times, with an exponential backoff that starts at initial and doubles for
+// each further retry, to a maximum of max.
+func Backoff(initial, max time.Duration, retries int) *RetryPolicy {
+	delays := make([]time.Duration, retries)
+	delay := initial
+	for i := range delays {
+		if delay > max {
+			delay = max
+		}
+		delays[i] = delay
+		delay *= 2
+	}
+	return &RetryPolicy{
+		Delays:      delays,
+		MaxAttempts: retries + 1,
+	}
+}
+
+// maxAttempts returns the maximum number of deliveries of a message
+func (policy *RetryPolicy) maxAttempts() int {
+	if policy.MaxAttempts > 0 {
+		return policy.MaxAttempts
+	}
+	return len(policy.Delays) + 1
+}
+
+// delay returns the delay to wait before the given retry (0 based)
+func (policy *RetryPolicy) delay(retry int) time.Duration {
+	if len(policy.Delays) == 0 {
+		return 0
+	}
+	if retry >= len(policy.Delays) {
+		retry = len(policy.Delays) - 1
+	}
+	return policy.Delays[retry]
+}
+
+// retrier manages the retry queues of a consumed queue, and republishes
+// failed messages to them
+type retrier struct {
+	policy *RetryPolicy
+	ch     *amqp.Channel
+	// publisher publishes failed messages to the retry queues (see
+	// PulseQueue.publisher)
+	publisher *publisher
+	exchange  string
+	queue    string
+	// anonymous is true if the consumed queue is an anonymous queue, in which
+	// case the retry queues expire after they are no longer used
+	anonymous bool
+	// deadLetters, if set, receives messages that have used up their
+	// attempts
+	deadLetters *deadLetterQueue
+}
+
+// declareRetryQueues declares the retry exchange and the retry queues for
+// the given queue, and binds them together.
+func (c *Connection) declareRetryQueues(ch *amqp.Channel, queue string, anonymous bool, policy *RetryPolicy) (*retrier, error) {
+	r := &retrier{
+		policy:    policy,
+		ch:        ch,
+		exchange:  "exchange/" + c.User + "/retry",
+		queue:     queue,
+		anonymous: anonymous,
+	}
+	err := ch.ExchangeDeclare(
+		r.exchange, // name
+		"direct",   // type
+		true,       // durable
+		false,      // auto-deleted
+		false,      // internal
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		return nil, c.opError("declare exchange", nil, err, "Failed to declare retry exchange "+r.exchange)
+	}
+	err = ch.QueueBind(
+		queue,      // queue name
+		queue,      // routing key
+		r.exchange, // exchange
+		false,
+		nil)
+	if err != nil {
+		return nil, c.opError("bind queue", nil, err, "Failed to bind queue to retry exchange")
+	}
+	for retry := 0; retry < len(policy.Delays); retry++ {
+		_, err := r.declare(policy.delay(retry))
+		if err != nil {
+			return nil, c.opError("declare queue", ErrQueueDeclare, err, "Failed to declare retry queue")
+		}
+	}
+	return r, nil
+}
+
+// declare declares and binds the retry queue for the given delay, returning
+// its name
+func (r *retrier) declare(delay time.Duration) (string, error) {
+	name := r.queue + "/retry/" + delay.String()
+	args := amqp.Table{
+		"x-message-ttl":             int64(delay / time.Millisecond),
+		"x-dead-letter-exchange":    r.exchange,
+		"x-dead-letter-routing-key": r.queue,
+	}
+	if r.anonymous {
+		// give waiting messages enough time to be dead-lettered back to the
+		// consumed queue before the retry queue expires
+		args["x-expires"] = int64((delay + time.Minute) / time.Millisecond)
+	}
+	_, err := r.ch.QueueDeclare(
+		name,  // name
+		false, // durable
+		false, // delete when usused
+		false, // exclusive
+		false, // no-wait
+		args,  // arguments
+	)
+	if err != nil {
+		return "", err
+	}
+	err = r.ch.QueueBind(
+		name,       // queue name
+		name,       // routing key
+		r.exchange, // exchange
+		false,
+		nil)
+	return name, err
+}
+
+// wrap intercepts nacks and rejects with requeue=true, so that they are
+// retried after a delay instead.
+func (r *retrier) wrap(d amqp.Delivery) amqp.Delivery {
+	return interceptRequeue(d, r.retry)
+}
+
+// retry publishes the delivery to the appropriate retry queue, and acks it
+// from the consumed queue. If the delivery has already used up its attempts,
+// it is moved to the dead letter queue if there is one, or otherwise
+// rejected.
+func (r *retrier) retry(d amqp.Delivery) error {
+	retries := headerInt(d.Headers, headerRetries)
+	if retries+1 >= r.policy.maxAttempts() {
+		if r.deadLetters != nil {
+			return r.deadLetters.route(d, fmt.Sprintf("gave up after %d attempts", retries+1))
+		}
+		log.Printf("Giving up on message from exchange %s with routing key %s after %d attempts", d.Exchange, d.RoutingKey, retries+1)
+		return d.Reject(false)
+	}
+	delay := r.policy.delay(retries)
+	retryQueue := r.queue + "/retry/" + delay.String()
+	if r.anonymous {
+		// redeclare, to reset the expiry of the retry queue
+		var err error
+		retryQueue, err = r.declare(delay)
+		if err != nil {
+			return Error(err, "Failed to declare retry queue")
+		}
+	}
+	err := r.publisher.publish(r.exchange, retryQueue, republished(d, amqp.Table{
+		headerRetries: int64(retries + 1),
+	}))
+	if err != nil {
+		return requeue(d, Error(err, "Failed to publish message to retry queue "+retryQueue))
+	}
+	return d.Ack(false)
+}
+
+// requeue returns a delivery that could not be republished to its queue, so
+// that it is not lost, and returns err
+func requeue(d amqp.Delivery, err error) error {
+	if nackErr := d.Nack(false, true); nackErr != nil {
+		log.Printf("Not able to requeue message: %v", nackErr)
+	}
+	return err
+}
+
+// restoreOrigin restores the original exchange and routing key of a
+// delivery that has been republished by this library (e.g. to a retry queue)
+func restoreOrigin(d amqp.Delivery) amqp.Delivery {
+	if exchange, ok := d.Headers[headerOriginalExchange].(string); ok {
+		d.Exchange = exchange
+	}
+	if routingKey, ok := d.Headers[headerOriginalRoutingKey].(string); ok {
+		d.RoutingKey = routingKey
+	}
+	return d
+}
+
+// republished returns a copy of the delivery for publishing, recording the
+// original exchange and routing key in its headers, and merging in the given
+// headers. A header with a nil value is removed.
+func republished(d amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	merged := amqp.Table{}
+	for k, v := range d.Headers {
+		merged[k] = v
+	}
+	merged[headerOriginalExchange] = d.Exchange
+	merged[headerOriginalRoutingKey] = d.RoutingKey
+	for k, v := range headers {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	return amqp.Publishing{
+		Headers:         merged,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// publishChannel is the part of *amqp.Channel used for publishing messages
+// with publisher confirms
+type publishChannel interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// publisher republishes messages (e.g. to retry and dead letter queues) on
+// a dedicated channel in confirm mode, so that a message only counts as
+// published once the server has confirmed that it was routed to a queue,
+// and the original can safely be acknowledged. The channel is opened when
+// first needed, and again after it has been closed by an error.
+type publisher struct {
+	open func() (publishChannel, error)
+
+	mu       sync.Mutex
+	ch       publishChannel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	// closed is true once the queue has stopped being consumed
+	closed bool
+}
+
+func newPublisher(conn *amqp.Connection) *publisher {
+	return &publisher{
+		open: func() (publishChannel, error) {
+			return conn.Channel()
+		},
+	}
+}
+
+// publish publishes msg as a mandatory message, and waits for the server to
+// confirm it. An error is returned if the message could not be routed to a
+// queue, or the server did not confirm it.
+func (p *publisher) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return Error(nil, "Queue is not being consumed")
+	}
+	if p.ch == nil {
+		ch, err := p.open()
+		if err != nil {
+			return Error(err, "Failed to open a channel")
+		}
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return Error(err, "Failed to put channel into confirm mode")
+		}
+		p.ch = ch
+		p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	}
+	err := p.ch.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory
+		false,      // immediate
+		msg,
+	)
+	if err != nil {
+		p.reset()
+		return err
+	}
+	confirm, ok := <-p.confirms
+	if !ok {
+		p.reset()
+		return Error(nil, "Channel closed before message was confirmed")
+	}
+	// the server returns an unroutable message before confirming it
+	select {
+	case returned := <-p.returns:
+		return Error(nil, fmt.Sprintf("Message returned as unroutable: %v", returned.ReplyText))
+	default:
+	}
+	if !confirm.Ack {
+		return Error(nil, "Message was not confirmed by the server")
+	}
+	return nil
+}
+
+// reset closes the channel of the publisher, so that a new one is opened
+// for the next message. The caller must hold p.mu.
+func (p *publisher) reset() {
+	if p.ch != nil {
+		p.ch.Close()
+		p.ch = nil
+	}
+}
+
+// close closes the channel of the publisher, if it is open
+func (p *publisher) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.reset()
+}
+
+// interceptRequeue returns a copy of the delivery whose nacks and rejects
+// with requeue=true are handled by the given requeue function, rather than
+// by the broker. Acks, and nacks and rejects without requeue, are passed
+// through unchanged.
+func interceptRequeue(d amqp.Delivery, requeue func(amqp.Delivery) error) amqp.Delivery {
+	original := d
+	d.Acknowledger = &requeueAcknowledger{
+		Acknowledger: d.Acknowledger,
+		requeue:      requeue,
+		delivery:     original,
+	}
+	return d
+}
+
+// requeueAcknowledger passes acks through to the underlying channel, but
+// hands nacks and rejects with requeue=true to a requeue function.
+type requeueAcknowledger struct {
+	amqp.Acknowledger
+	requeue  func(amqp.Delivery) error
+	delivery amqp.Delivery
+}
+
+func (a *requeueAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if !requeue || multiple {
+		return a.Acknowledger.Nack(tag, multiple, requeue)
+	}
+	return a.requeue(a.delivery)
+}
+
+func (a *requeueAcknowledger) Reject(tag uint64, requeue bool) error {
+	if !requeue {
+		return a.Acknowledger.Reject(tag, requeue)
+	}
+	return a.requeue(a.delivery)
+}
+
+// headerInt returns the integer value of the given header, or 0 if it is not
+// set or is not an integer
+func headerInt(headers amqp.Table, key string) int {
+	switch v := headers[key].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	}
+	return 0
+}
@@ -0,0 +1,143 @@
+package pulse
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// recordingAcknowledger records the acknowledgements it receives, in place of
+// an AMQP channel
+type recordingAcknowledger struct {
+	acks, nacks, rejects []uint64
+	requeued             []bool
+}
+
+func (a *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks = append(a.acks, tag)
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks = append(a.nacks, tag)
+	a.requeued = append(a.requeued, requeue)
+	return nil
+}
+
+func (a *recordingAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.rejects = append(a.rejects, tag)
+	a.requeued = append(a.requeued, requeue)
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	policy := Backoff(time.Second, 5*time.Second, 5)
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, delay := range expected {
+		if policy.delay(i) != delay {
+			t.Errorf("Expected retry %v to have delay %v but got %v", i, delay, policy.delay(i))
+		}
+	}
+	if policy.delay(10) != 5*time.Second {
+		t.Errorf("Expected last delay to be reused, but got %v", policy.delay(10))
+	}
+	if policy.maxAttempts() != 6 {
+		t.Errorf("Expected 6 attempts, but got %v", policy.maxAttempts())
+	}
+	if (&RetryPolicy{Delays: expected}).maxAttempts() != 6 {
+		t.Errorf("Expected MaxAttempts to default to one attempt per delay plus the first delivery")
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	r := &retrier{
+		policy: &RetryPolicy{Delays: []time.Duration{time.Second}, MaxAttempts: 3},
+		queue:  "queue/pmoore_test1/taskprocessing",
+	}
+	ack := &recordingAcknowledger{}
+	d := r.wrap(restoreOrigin(amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  7,
+		Exchange:     "exchange/pmoore_test1/retry",
+		RoutingKey:   "queue/pmoore_test1/taskprocessing",
+		Headers: amqp.Table{
+			headerRetries:            int64(2),
+			headerOriginalExchange:   "exchange/build/",
+			headerOriginalRoutingKey: "a.b.c",
+		},
+	}))
+	if d.Exchange != "exchange/build/" || d.RoutingKey != "a.b.c" {
+		t.Errorf("Original exchange and routing key not restored: %v %v", d.Exchange, d.RoutingKey)
+	}
+	err := d.Nack(false, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ack.rejects) != 1 || ack.rejects[0] != 7 || ack.requeued[0] {
+		t.Errorf("Expected message to be rejected without requeue after 3 attempts, but got %#v", ack)
+	}
+
+	// nacks without requeue pass straight through
+	ack = &recordingAcknowledger{}
+	d = r.wrap(amqp.Delivery{Acknowledger: ack, DeliveryTag: 8})
+	d.Nack(false, false)
+	if len(ack.nacks) != 1 || ack.requeued[0] {
+		t.Errorf("Expected nack without requeue to pass through, but got %#v", ack)
+	}
+}
+
+// fakePublisher returns a publisher that publishes on ch
+func fakePublisher(ch *fakeChannel) *publisher {
+	return &publisher{open: func() (publishChannel, error) { return ch, nil }}
+}
+
+func TestRetryRepublishesBeforeAck(t *testing.T) {
+	ch := &fakeChannel{}
+	r := &retrier{
+		policy:    &RetryPolicy{Delays: []time.Duration{time.Second}, MaxAttempts: 3},
+		publisher: fakePublisher(ch),
+		exchange:  "exchange/pmoore_test1/retry",
+		queue:     "queue/pmoore_test1/taskprocessing",
+	}
+	ack := &recordingAcknowledger{}
+	d := r.wrap(amqp.Delivery{Acknowledger: ack, DeliveryTag: 3, Exchange: "exchange/build/", RoutingKey: "a.b.c"})
+	if err := d.Nack(false, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ch.published) != 1 || ch.published[0].routingKey != "queue/pmoore_test1/taskprocessing/retry/1s" || ch.published[0].msg.Headers[headerRetries] != int64(1) {
+		t.Errorf("Expected message to be published to retry queue, but got %#v", ch.published)
+	}
+	if len(ack.acks) != 1 || len(ack.nacks) != 0 {
+		t.Errorf("Expected confirmed message to be acked, but got %#v", ack)
+	}
+
+	// a message that cannot be routed to the retry queue is requeued, rather
+	// than lost
+	ch.unroutable = "queue/pmoore_test1/taskprocessing/retry/1s"
+	ack = &recordingAcknowledger{}
+	d = r.wrap(amqp.Delivery{Acknowledger: ack, DeliveryTag: 4})
+	if err := d.Nack(false, true); err == nil {
+		t.Errorf("Expected error publishing unroutable message")
+	}
+	if len(ack.acks) != 0 || len(ack.nacks) != 1 || !ack.requeued[0] {
+		t.Errorf("Expected unroutable message to be requeued, but got %#v", ack)
+	}
+
+	// once the queue has stopped being consumed, nothing is published
+	r.publisher.close()
+	ack = &recordingAcknowledger{}
+	d = r.wrap(amqp.Delivery{Acknowledger: ack, DeliveryTag: 5})
+	if err := d.Nack(false, true); err == nil || len(ch.published) != 2 {
+		t.Errorf("Expected publishing to fail once closed, but got %v and %v messages", err, len(ch.published))
+	}
+}
+
+func TestRetryPolicyWithoutDelays(t *testing.T) {
+	conn := NewConnection("", "", "amqp://localhost")
+	_, err := conn.ConsumeWithOptions("tasks", nil, ConsumeOptions{Retry: &RetryPolicy{MaxAttempts: 3}})
+	if err == nil || !strings.Contains(err.Error(), "at least one delay") {
+		t.Errorf("Expected retry policy without delays to be rejected, but got %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package pulse
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FieldedBinding is a Binding that also names the dot-separated fields of the
+// routing keys of its exchange. For example, the routing keys of taskcluster
+// queue exchanges have fields:
+//
+//  	routingKeyKind, taskId, runId, workerGroup, workerId, provisionerId,
+//  	workerType, schedulerId, taskGroupId, reserved
+//
+// Messages that match a FieldedBinding provide access to the values of the
+// fields of their routing key via Message.Fields and Message.DecodeFields.
+//
+// By convention, a final field named "reserved" matches any number of
+// trailing words of the routing key.
+type FieldedBinding interface {
+	Binding
+
+	// This should return the names of the fields of the routing key, in
+	// order
+	RoutingKeyFields() []string
+}
+
+// fieldBinding is a simpleBinding with named routing key fields
+type fieldBinding struct {
+	simpleBinding
+	fields []string
+}
+
+// BindFields returns a FieldedBinding for the given exchange, whose routing
+// key fields are named by fieldNames. The routing key pattern of the binding
+// is built by RoutingKeyPattern from the given values. For example:
+//
+//  	binding, err := pulse.BindFields(
+//  		"exchange/taskcluster-queue/v1/task-defined",
+//  		[]string{"routingKeyKind", "taskId", "runId", "workerGroup", "workerId",
+//  			"provisionerId", "workerType", "schedulerId", "taskGroupId", "reserved"},
+//  		map[string]string{"provisionerId": "null-provisioner", "workerType": "buildbot-try"},
+//  	)
+//
+// binds with routing key "*.*.*.*.*.null-provisioner.buildbot-try.*.*.#".
+// An error is returned if a value contains '.', '*' or '#', since it would not
+// match a single word of the routing key.
+func BindFields(exchangeName string, fieldNames []string, values map[string]string) (FieldedBinding, error) {
+	for _, name := range fieldNames {
+		if err := checkFieldValue(name, values[name]); err != nil {
+			return nil, err
+		}
+	}
+	return &fieldBinding{
+		simpleBinding: simpleBinding{
+			rk: RoutingKeyPattern(fieldNames, values),
+			en: exchangeName,
+		},
+		fields: fieldNames,
+	}, nil
+}
+
+// checkFieldValue returns an error if value, the value of the routing key
+// field with the given name, would not match a single word of a routing key
+func checkFieldValue(name string, value string) error {
+	if strings.ContainsAny(value, ".*#") {
+		return Error(nil, fmt.Sprintf("Routing key field %v has invalid value %q", name, value))
+	}
+	return nil
+}
+
+// RoutingKeyFields returns the field names the fieldBinding was created with
+// in the BindFields function above
+func (f fieldBinding) RoutingKeyFields() []string {
+	return f.fields
+}
+
+// RoutingKeyPattern builds a routing key pattern from the given field names
+// and values. Fields without a value (or with an empty value) match any word
+// ("*"), except for a final field named "reserved", which matches any
+// remaining words ("#").
+func RoutingKeyPattern(fieldNames []string, values map[string]string) string {
+	words := make([]string, len(fieldNames))
+	for i, name := range fieldNames {
+		switch value := values[name]; {
+		case value != "":
+			words[i] = value
+		case name == "reserved" && i == len(fieldNames)-1:
+			words[i] = "#"
+		default:
+			words[i] = "*"
+		}
+	}
+	return strings.Join(words, ".")
+}
+
+// parseFields maps the words of routingKey to the given field names. If there
+// are more words than field names, the last field receives all remaining
+// words, joined by '.'.
+func parseFields(fieldNames []string, routingKey string) map[string]string {
+	fields := make(map[string]string, len(fieldNames))
+	if len(fieldNames) == 0 {
+		return fields
+	}
+	words := strings.SplitN(routingKey, ".", len(fieldNames))
+	for i, word := range words {
+		fields[fieldNames[i]] = word
+	}
+	return fields
+}
+
+// Fields returns the values of the fields of the routing key of the message,
+// keyed by field name, if the binding the message matched is (or decorates)
+// a FieldedBinding. Otherwise it returns nil.
+func (msg Message) Fields() map[string]string {
+	fielded, ok := findBinding[FieldedBinding](msg.Binding)
+	if !ok || fielded.RoutingKeyFields() == nil {
+		return nil
+	}
+	return parseFields(fielded.RoutingKeyFields(), msg.RoutingKey)
+}
+
+// DecodeFields stores the values of the fields of the routing key of the
+// message (see Fields) in the struct pointed to by v. Each struct field with
+// a `routingkey:"<name>"` tag receives the value of the routing key field
+// with that name. Struct fields may be strings, or integers, in which case
+// the routing key field is parsed as a decimal number, or pointers to these.
+// Tagged fields without a value in the routing key are set to their zero
+// value (or nil). For example:
+//
+//  	var fields struct {
+//  		TaskID string `routingkey:"taskId"`
+//  		RunID  int    `routingkey:"runId"`
+//  	}
+//  	err := msg.DecodeFields(&fields)
+func (msg Message) DecodeFields(v interface{}) error {
+	fields := msg.Fields()
+	if fields == nil {
+		return Error(nil, "Message binding does not define routing key fields")
+	}
+	return decodeFields(fields, v)
+}
+
+// decodeFields stores the given field values in the tagged fields of the
+// struct pointed to by v
+func decodeFields(fields map[string]string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return Error(nil, fmt.Sprintf("Cannot decode routing key fields into %T - need a pointer to a struct", v))
+	}
+	rv = rv.Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		name, ok := rv.Type().Field(i).Tag.Lookup("routingkey")
+		if !ok {
+			continue
+		}
+		field := rv.Field(i)
+		if !field.CanSet() {
+			return Error(nil, fmt.Sprintf("Cannot decode routing key field %v into unexported field %v of %v", name, rv.Type().Field(i).Name, rv.Type()))
+		}
+		// clear any value left over from decoding into the same struct before
+		field.Set(reflect.Zero(field.Type()))
+		value, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+			if err != nil {
+				return Error(err, fmt.Sprintf("Routing key field %v has invalid value %q", name, value))
+			}
+			field.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+			if err != nil {
+				return Error(err, fmt.Sprintf("Routing key field %v has invalid value %q", name, value))
+			}
+			field.SetUint(n)
+		default:
+			return Error(nil, fmt.Sprintf("Cannot decode routing key field %v into %v", name, field.Type()))
+		}
+	}
+	return nil
+}
+
+// structFields returns the routing key field names and values of the tagged
+// fields of the struct v (or pointer to a struct v), in field order. Zero
+// values (and nil pointers) are returned as empty strings.
+func structFields(v interface{}) ([]string, map[string]string, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, nil, Error(nil, fmt.Sprintf("Cannot derive routing key fields from %T - need a struct", v))
+	}
+	names := []string{}
+	values := map[string]string{}
+	for i := 0; i < rv.NumField(); i++ {
+		name, ok := rv.Type().Field(i).Tag.Lookup("routingkey")
+		if !ok {
+			continue
+		}
+		names = append(names, name)
+		field := rv.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		} else if field.IsZero() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			values[name] = field.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			values[name] = strconv.FormatInt(field.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			values[name] = strconv.FormatUint(field.Uint(), 10)
+		default:
+			return nil, nil, Error(nil, fmt.Sprintf("Cannot use %v as routing key field %v", field.Type(), name))
+		}
+		if err := checkFieldValue(name, values[name]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return names, values, nil
+}
+
+// RoutingKey builds a routing key pattern from the struct v, whose fields
+// with a `routingkey:"<name>"` tag describe the fields of the routing key, in
+// order. Zero valued fields match any word ("*"), except for a final field
+// named "reserved", which matches any remaining words ("#"). Use pointer
+// fields to match zero values, such as a runId of 0. For example:
+//
+//  	type TaskDefined struct {
+//  		RoutingKeyKind string `routingkey:"routingKeyKind"`
+//  		TaskID         string `routingkey:"taskId"`
+//  		RunID          *int   `routingkey:"runId"`
+//  		WorkerGroup    string `routingkey:"workerGroup"`
+//  		WorkerID       string `routingkey:"workerId"`
+//  		ProvisionerID  string `routingkey:"provisionerId"`
+//  		WorkerType     string `routingkey:"workerType"`
+//  		SchedulerID    string `routingkey:"schedulerId"`
+//  		TaskGroupID    string `routingkey:"taskGroupId"`
+//  		Reserved       string `routingkey:"reserved"`
+//  	}
+//
+//  	rk, err := pulse.RoutingKey(TaskDefined{
+//  		ProvisionerID: "null-provisioner",
+//  		WorkerType:    "buildbot-try",
+//  	})
+//
+// returns "*.*.*.*.*.null-provisioner.buildbot-try.*.*.#".
+func RoutingKey(v interface{}) (string, error) {
+	names, values, err := structFields(v)
+	if err != nil {
+		return "", err
+	}
+	return RoutingKeyPattern(names, values), nil
+}
+
+// ParseRoutingKey is the reverse of RoutingKey: it stores the words of
+// routingKey in the tagged fields of the struct pointed to by v, in order.
+// If there are more words than tagged fields, the last field receives all
+// remaining words, joined by '.'. If there are fewer, the remaining fields are
+// set to their zero value (or nil).
+func ParseRoutingKey(routingKey string, v interface{}) error {
+	rt := reflect.TypeOf(v)
+	if rt == nil || rt.Kind() != reflect.Ptr || rt.Elem().Kind() != reflect.Struct {
+		return Error(nil, fmt.Sprintf("Cannot parse routing key into %T - need a pointer to a struct", v))
+	}
+	names := []string{}
+	for i := 0; i < rt.Elem().NumField(); i++ {
+		if name, ok := rt.Elem().Field(i).Tag.Lookup("routingkey"); ok {
+			names = append(names, name)
+		}
+	}
+	return decodeFields(parseFields(names, routingKey), v)
+}
+
+// BindStruct returns a FieldedBinding for the given exchange, whose routing
+// key fields, and routing key pattern, are derived from the struct v as
+// described for RoutingKey.
+func BindStruct(exchangeName string, v interface{}) (FieldedBinding, error) {
+	names, values, err := structFields(v)
+	if err != nil {
+		return nil, err
+	}
+	return BindFields(exchangeName, names, values)
+}
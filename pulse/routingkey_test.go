@@ -0,0 +1,142 @@
+package pulse
+
+import (
+	"strings"
+	"testing"
+)
+
+var taskFields = []string{"routingKeyKind", "taskId", "runId", "workerGroup", "workerId", "provisionerId", "workerType", "schedulerId", "taskGroupId", "reserved"}
+
+func TestRoutingKeyPattern(t *testing.T) {
+	binding, err := BindFields(
+		"exchange/taskcluster-queue/v1/task-defined",
+		taskFields,
+		map[string]string{"provisionerId": "null-provisioner", "workerType": "buildbot-try"},
+	)
+	if err != nil {
+		t.Fatalf("Could not bind fields: %v", err)
+	}
+	if rk := binding.RoutingKey(); rk != "*.*.*.*.*.null-provisioner.buildbot-try.*.*.#" {
+		t.Errorf("Unexpected routing key pattern %q", rk)
+	}
+	for _, value := range []string{"a.b", "*", "#"} {
+		if _, err := BindFields("exchange/taskcluster-queue/v1/task-defined", taskFields, map[string]string{"taskId": value}); err == nil {
+			t.Errorf("Expected error binding taskId %q", value)
+		}
+	}
+	if rk := RoutingKeyPattern([]string{"a", "b"}, nil); rk != "*.*" {
+		t.Errorf("Unexpected routing key pattern %q", rk)
+	}
+}
+
+func TestMessageFields(t *testing.T) {
+	binding, err := BindFields("exchange/taskcluster-queue/v1/task-defined", taskFields, nil)
+	if err != nil {
+		t.Fatalf("Could not bind fields: %v", err)
+	}
+	msg := Message{
+		Binding:    binding,
+		RoutingKey: "primary.fH3bP5ZdQ2GFyb6RfgbO_Q.2.us-west-2.i-0a1b.aws-provisioner-v1.gecko-t-linux.tc.fH3bP5ZdQ2GFyb6RfgbO_Q._.extra",
+	}
+	fields := msg.Fields()
+	if fields["taskId"] != "fH3bP5ZdQ2GFyb6RfgbO_Q" || fields["workerType"] != "gecko-t-linux" || fields["reserved"] != "_.extra" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+	var decoded struct {
+		TaskID     string `routingkey:"taskId"`
+		RunID      int    `routingkey:"runId"`
+		WorkerType string `routingkey:"workerType"`
+		Ignored    string
+	}
+	err = msg.DecodeFields(&decoded)
+	if err != nil {
+		t.Fatalf("Could not decode fields: %v", err)
+	}
+	if decoded.TaskID != "fH3bP5ZdQ2GFyb6RfgbO_Q" || decoded.RunID != 2 || decoded.WorkerType != "gecko-t-linux" {
+		t.Errorf("Unexpected decoded fields %#v", decoded)
+	}
+
+	msg.RoutingKey = "primary.abc.notanumber.x"
+	if err := msg.DecodeFields(&decoded); err == nil {
+		t.Errorf("Expected error decoding non-numeric runId")
+	}
+	if (Message{Binding: Bind("#", "exchange/build/")}).Fields() != nil {
+		t.Errorf("Expected no fields for binding without field names")
+	}
+}
+
+type taskRoutingKey struct {
+	RoutingKeyKind string `routingkey:"routingKeyKind"`
+	TaskID         string `routingkey:"taskId"`
+	RunID          *int   `routingkey:"runId"`
+	WorkerGroup    string `routingkey:"workerGroup"`
+	WorkerID       string `routingkey:"workerId"`
+	ProvisionerID  string `routingkey:"provisionerId"`
+	WorkerType     string `routingkey:"workerType"`
+	SchedulerID    string `routingkey:"schedulerId"`
+	TaskGroupID    string `routingkey:"taskGroupId"`
+	Reserved       string `routingkey:"reserved"`
+	Ignored        string
+}
+
+func TestRoutingKeyFromStruct(t *testing.T) {
+	rk, err := RoutingKey(taskRoutingKey{ProvisionerID: "null-provisioner", WorkerType: "buildbot-try"})
+	if err != nil || rk != "*.*.*.*.*.null-provisioner.buildbot-try.*.*.#" {
+		t.Errorf("Unexpected routing key %q (error %v)", rk, err)
+	}
+	zero := 0
+	rk, err = RoutingKey(&taskRoutingKey{RunID: &zero, Reserved: "_"})
+	if err != nil || rk != "*.*.0.*.*.*.*.*.*._" {
+		t.Errorf("Unexpected routing key %q (error %v)", rk, err)
+	}
+	if _, err := RoutingKey(taskRoutingKey{WorkerType: "a.b"}); err == nil {
+		t.Errorf("Expected error for field value containing '.'")
+	}
+	if _, err := RoutingKey("not a struct"); err == nil {
+		t.Errorf("Expected error for non-struct")
+	}
+
+	var parsed taskRoutingKey
+	err = ParseRoutingKey("primary.abc.3.wg.wid.null-provisioner.buildbot-try.tc.grp._", &parsed)
+	if err != nil {
+		t.Fatalf("Could not parse routing key: %v", err)
+	}
+	if parsed.TaskID != "abc" || parsed.RunID == nil || *parsed.RunID != 3 || parsed.WorkerType != "buildbot-try" || parsed.Reserved != "_" {
+		t.Errorf("Unexpected parsed routing key %#v", parsed)
+	}
+
+	binding, err := BindStruct("exchange/taskcluster-queue/v1/task-defined", taskRoutingKey{WorkerType: "gaia"})
+	if err != nil || binding.RoutingKey() != "*.*.*.*.*.*.gaia.*.*.#" || len(binding.RoutingKeyFields()) != 10 {
+		t.Errorf("Unexpected binding %#v (error %v)", binding, err)
+	}
+}
+
+func TestParseRoutingKeyReusesStruct(t *testing.T) {
+	var parsed taskRoutingKey
+	for _, rk := range []string{"primary.a.0.wg.wid.p.wt.s.g._.x", "primary.b.1.wg.wid.p.wt.s.g._"} {
+		if err := ParseRoutingKey(rk, &parsed); err != nil {
+			t.Errorf("Could not parse routing key %q: %v", rk, err)
+		}
+	}
+	if parsed.TaskID != "b" || parsed.Reserved != "_" {
+		t.Errorf("Unexpected parsed routing key %#v", parsed)
+	}
+	// fields missing from a shorter routing key are cleared
+	if err := ParseRoutingKey("primary.c", &parsed); err != nil {
+		t.Errorf("Could not parse routing key %q: %v", "primary.c", err)
+	}
+	if parsed.TaskID != "c" || parsed.RunID != nil || parsed.WorkerGroup != "" || parsed.Reserved != "" {
+		t.Errorf("Expected fields missing from routing key to be cleared, but got %#v", parsed)
+	}
+}
+
+func TestParseRoutingKeyUnexportedField(t *testing.T) {
+	var parsed struct {
+		TaskID string `routingkey:"taskId"`
+		runID  string `routingkey:"runId"`
+	}
+	err := ParseRoutingKey("abc.0", &parsed)
+	if _, ok := err.(PulseError); !ok || !strings.Contains(err.Error(), "unexported field runID") {
+		t.Errorf("Expected PulseError for unexported field, but got %v", err)
+	}
+}
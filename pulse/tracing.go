@@ -0,0 +1,150 @@
+package pulse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the OpenTelemetry tracer used by this package
+const tracerName = "github.com/taskcluster/pulse-go/pulse"
+
+// headerCarrier adapts the headers of an AMQP message to a
+// propagation.TextMapCarrier, so that trace context (such as the W3C
+// "traceparent" header) can be propagated with messages
+type headerCarrier amqp.Table
+
+func (h headerCarrier) Get(key string) string {
+	switch value := h[key].(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	}
+	return ""
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h[key] = value
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// messageAttributes returns the span attributes describing a message
+func messageAttributes(operation, exchange, routingKey, messageID string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.operation", operation),
+		attribute.String("messaging.destination.name", exchange),
+		attribute.String("messaging.rabbitmq.destination.routing_key", routingKey),
+	}
+	if messageID != "" {
+		attrs = append(attrs, attribute.String("messaging.message.id", messageID))
+	}
+	return attrs
+}
+
+// Tracing returns middleware that traces the processing of messages with
+// OpenTelemetry, using the global tracer provider and propagator (see
+// otel.SetTracerProvider and otel.SetTextMapPropagator). Trace context is
+// extracted from the headers of each message, and a consumer span, with the
+// exchange and routing key as attributes, is started as its child. The
+// handler receives the span in its context, so that any spans it starts
+// belong to the trace of the publisher. Callbacks of Consume and
+// ConsumeWithOptions do not receive a context, so the span just covers the
+// callback. Only messages passed through middleware are traced: messages
+// consumed via ConsumeBatch or Subscribe, which do not apply middleware, get
+// no spans, nor do messages of queues not using Tracing, although their
+// headers still carry the trace context of the publisher.
+func Tracing() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(msg.Headers))
+			ctx, span := otel.Tracer(tracerName).Start(
+				ctx,
+				msg.Exchange+" process",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(messageAttributes("process", msg.Exchange, msg.RoutingKey, msg.MessageID)...),
+			)
+			defer span.End()
+			err := next(ctx, msg)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return err
+		}
+	}
+}
+
+// Publish publishes msg to the given exchange with the given routing key,
+// connecting to pulse first if not already connected. The trace context of
+// ctx is injected into the headers of the message using the global
+// OpenTelemetry propagator, within a producer span, so that consumers using
+// Tracing continue the trace. The headers of msg are not modified.
+func (c *Connection) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	// TODO: this needs to be synchronised
+	if !c.connected {
+		err := c.connect()
+		if err != nil {
+			return err
+		}
+	}
+	ctx, span := otel.Tracer(tracerName).Start(
+		ctx,
+		exchange+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(messageAttributes("publish", exchange, routingKey, msg.MessageId)...),
+	)
+	defer span.End()
+
+	err := c.publish(exchange, routingKey, injectTraceContext(ctx, msg))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// injectTraceContext returns msg with the trace context of ctx injected into
+// a copy of its headers, using the global OpenTelemetry propagator
+func injectTraceContext(ctx context.Context, msg amqp.Publishing) amqp.Publishing {
+	headers := make(amqp.Table, len(msg.Headers))
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(headers))
+	msg.Headers = headers
+	return msg
+}
+
+// publish publishes msg on a dedicated channel, which is closed afterwards
+func (c *Connection) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	ch, err := c.AMQPConn.Channel()
+	if err != nil {
+		return c.opError("open channel", ErrConnection, err, "Failed to open a channel")
+	}
+	defer ch.Close()
+	err = ch.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		msg,
+	)
+	if err != nil {
+		return c.opError("publish", nil, err, fmt.Sprintf("Failed to publish message to exchange %v with routing key %v", exchange, routingKey))
+	}
+	return nil
+}
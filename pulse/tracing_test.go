@@ -0,0 +1,74 @@
+package pulse
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingContinuesTrace(t *testing.T) {
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		TraceFlags: trace.FlagsSampled,
+	})
+	headers := amqp.Table{"x-other": int64(1)}
+	otel.GetTextMapPropagator().Inject(trace.ContextWithSpanContext(context.Background(), parent), headerCarrier(headers))
+	if headers["traceparent"] == nil {
+		t.Fatalf("Expected traceparent header to be set, but got %#v", headers)
+	}
+
+	var traceID trace.TraceID
+	handler := Tracing()(func(ctx context.Context, msg Message) error {
+		traceID = trace.SpanContextFromContext(ctx).TraceID()
+		return nil
+	})
+	if err := handler(context.Background(), Message{Exchange: "exchange/test", RoutingKey: "a.b", Headers: headers}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if traceID != parent.TraceID() {
+		t.Errorf("Expected handler context to continue trace %v, but got %v", parent.TraceID(), traceID)
+	}
+
+	// headers may also arrive as []byte
+	carrier := headerCarrier(amqp.Table{"traceparent": []byte(headers["traceparent"].(string))})
+	if carrier.Get("traceparent") != headers["traceparent"] {
+		t.Errorf("Expected []byte header to be read as a string, but got %q", carrier.Get("traceparent"))
+	}
+}
+
+func TestPublishInjectsTraceContext(t *testing.T) {
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+		SpanID:     trace.SpanID{8, 7, 6, 5, 4, 3, 2, 1},
+		TraceFlags: trace.FlagsSampled,
+	})
+	original := amqp.Table{"x-other": int64(1)}
+	msg := injectTraceContext(trace.ContextWithSpanContext(context.Background(), parent), amqp.Publishing{Headers: original})
+	if len(original) != 1 {
+		t.Errorf("Expected headers of message not to be modified, but got %#v", original)
+	}
+	if msg.Headers["x-other"] != int64(1) {
+		t.Errorf("Expected existing headers to be kept, but got %#v", msg.Headers)
+	}
+
+	var traceID trace.TraceID
+	handler := Tracing()(func(ctx context.Context, msg Message) error {
+		traceID = trace.SpanContextFromContext(ctx).TraceID()
+		return nil
+	})
+	handler(context.Background(), Message{Exchange: "exchange/test", RoutingKey: "a.b", Headers: msg.Headers})
+	if traceID != parent.TraceID() {
+		t.Errorf("Expected published message to carry trace %v, but got %v from headers %#v", parent.TraceID(), traceID, msg.Headers)
+	}
+}
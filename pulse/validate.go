@@ -0,0 +1,175 @@
+package pulse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/streadway/amqp"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// StrictJSONCodec unmarshals json bodies into the payload object, like
+// JSONCodec, but fails if the body contains fields that the payload object
+// does not have. It is used for json messages matching a binding created by
+// WithValidation with DisallowUnknownFields set.
+var StrictJSONCodec Codec = CodecFunc(decodeStrictJSON)
+
+func decodeStrictJSON(body []byte, payloadObject interface{}) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payloadObject); err != nil {
+		return payloadObject, err
+	}
+	if decoder.More() {
+		return payloadObject, Error(nil, "Unexpected data after json payload")
+	}
+	return payloadObject, nil
+}
+
+// ValidationOptions describe how the messages matching a binding created by
+// WithValidation are checked before being passed to the callback.
+type ValidationOptions struct {
+	// DisallowUnknownFields causes json messages that contain fields that
+	// the payload object does not have to be rejected (see StrictJSONCodec)
+	DisallowUnknownFields bool
+	// Schema, if set, is a JSON Schema document that the (decompressed)
+	// body of each message must conform to, such as the schema taskcluster
+	// publishes for the exchange
+	Schema []byte
+}
+
+// validatingBinding decorates a Binding with validation of the messages it
+// matches
+type validatingBinding struct {
+	Binding
+	strict bool
+	schema *gojsonschema.Schema
+}
+
+// WithValidation returns a Binding that behaves like binding, except that
+// the messages it matches are validated as described by options. Messages
+// that fail validation, or cannot be decoded, are not passed to the
+// callback. Instead the failure is reported as a *DecodeError to
+// ConsumeOptions.OnDecodeError, and the message is rejected, or moved to the
+// dead letter queue if ConsumeOptions.DeadLetter is set. For example:
+//
+//  	binding, err := pulse.WithValidation(
+//  		pulse.Bind("#", "exchange/taskcluster-queue/v1/task-defined"),
+//  		pulse.ValidationOptions{
+//  			DisallowUnknownFields: true,
+//  			Schema:                taskDefinedSchema,
+//  		},
+//  	)
+//
+// An error is returned if the schema is not a valid JSON Schema document.
+func WithValidation(binding Binding, options ValidationOptions) (Binding, error) {
+	v := &validatingBinding{
+		Binding: binding,
+		strict:  options.DisallowUnknownFields,
+	}
+	if options.Schema != nil {
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(options.Schema))
+		if err != nil {
+			return nil, Error(err, "Invalid JSON schema for exchange "+binding.ExchangeName())
+		}
+		v.schema = schema
+	}
+	return v, nil
+}
+
+// Unwrap returns the decorated binding
+func (v *validatingBinding) Unwrap() Binding {
+	return v.Binding
+}
+
+// validate checks body against the schema of the binding, if it has one
+func (v *validatingBinding) validate(body []byte) error {
+	if v.schema == nil {
+		return nil
+	}
+	result, err := v.schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+	violations := make([]string, len(result.Errors()))
+	for i, violation := range result.Errors() {
+		violations[i] = violation.String()
+	}
+	return &schemaViolations{violations: violations}
+}
+
+// schemaViolations is the error returned by validate for a message that does
+// not conform to the schema
+type schemaViolations struct {
+	violations []string
+}
+
+func (err *schemaViolations) Error() string {
+	return "Message does not conform to schema: " + strings.Join(err.violations, "; ")
+}
+
+// DecodeError describes a message that failed validation, or could not be
+// decoded, for a binding created by WithValidation.
+type DecodeError struct {
+	Exchange   string
+	RoutingKey string
+	// Body is the (decompressed) body of the message
+	Body []byte
+	// Violations lists how the body failed to conform to the schema of the
+	// binding, if it did
+	Violations []string
+	// Err is the underlying validation or decoding error
+	Err error
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("Invalid message on exchange %v with routing key %v: %v", err.Exchange, err.RoutingKey, err.Err)
+}
+
+// Unwrap returns the underlying validation or decoding error
+func (err *DecodeError) Unwrap() error {
+	return err.Err
+}
+
+// newDecodeError returns a DecodeError for the delivery with the given
+// (decompressed) body
+func newDecodeError(d amqp.Delivery, body []byte, err error) *DecodeError {
+	decodeErr := &DecodeError{
+		Exchange:   d.Exchange,
+		RoutingKey: d.RoutingKey,
+		Body:       body,
+		Err:        err,
+	}
+	if violations, ok := err.(*schemaViolations); ok {
+		decodeErr.Violations = violations.violations
+	}
+	return decodeErr
+}
+
+// invalid reports a delivery that failed validation, and rejects it, or moves
+// it to the dead letter queue if there is one
+func (sub *subscription) invalid(d amqp.Delivery, err *DecodeError) {
+	if sub.onDecodeError != nil {
+		sub.onDecodeError(err)
+	} else {
+		log.Printf("%v", err)
+	}
+	if sub.autoAck {
+		return
+	}
+	if deadLetters := sub.pulseQueue.deadLetters; deadLetters != nil {
+		if dlErr := deadLetters.route(d, err.Error()); dlErr != nil {
+			log.Printf("Not able to move invalid message to dead letter queue: %v", dlErr)
+		}
+		return
+	}
+	if rejectErr := d.Reject(false); rejectErr != nil {
+		log.Printf("Not able to reject invalid message: %v", rejectErr)
+	}
+}
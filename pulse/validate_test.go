@@ -0,0 +1,85 @@
+package pulse
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+const taskDefinedSchema = `{
+	"type": "object",
+	"properties": {
+		"taskId": {"type": "string", "pattern": "^[a-z]+$"}
+	},
+	"required": ["taskId"]
+}`
+
+func TestValidation(t *testing.T) {
+	binding := &typedBinding{rk: "#", en: "exchange/test"}
+	strict, err := WithValidation(binding, ValidationOptions{DisallowUnknownFields: true})
+	if err != nil {
+		t.Fatalf("Could not create validating binding: %v", err)
+	}
+	validated, err := WithValidation(binding, ValidationOptions{Schema: []byte(taskDefinedSchema)})
+	if err != nil {
+		t.Fatalf("Could not create validating binding: %v", err)
+	}
+	if _, err := WithValidation(binding, ValidationOptions{Schema: []byte(`{"type": 7}`)}); err == nil {
+		t.Errorf("Expected error creating binding with invalid schema")
+	}
+
+	for _, b := range []Binding{binding, strict, validated} {
+		if _, err := decodePayload(b, amqp.Delivery{Body: []byte(`{"taskId": "abc"}`)}); err != nil {
+			t.Errorf("Could not decode valid message with %#v: %v", b, err)
+		}
+	}
+
+	// unknown fields are only rejected by the strict binding
+	body := []byte(`{"taskId": "abc", "extra": true}`)
+	if _, err := decodePayload(binding, amqp.Delivery{Body: body}); err != nil {
+		t.Errorf("Expected unknown fields to be ignored, but got: %v", err)
+	}
+	var decodeErr *DecodeError
+	_, err = decodePayload(strict, amqp.Delivery{Body: body, Exchange: "exchange/test", RoutingKey: "a.b"})
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("Expected *DecodeError for unknown field, but got: %v", err)
+	}
+	if decodeErr.Exchange != "exchange/test" || decodeErr.RoutingKey != "a.b" || string(decodeErr.Body) != string(body) {
+		t.Errorf("Unexpected details in %#v", decodeErr)
+	}
+
+	// schema violations are listed, and compressed bodies are validated
+	// once decompressed
+	_, err = decodePayload(validated, amqp.Delivery{Body: gzipped(t, `{"taskId": "ABC"}`), ContentEncoding: "gzip"})
+	if !errors.As(err, &decodeErr) || len(decodeErr.Violations) != 1 {
+		t.Fatalf("Expected *DecodeError with one violation, but got: %#v", err)
+	}
+	_, err = decodePayload(validated, amqp.Delivery{Body: []byte(`{}`)})
+	if !errors.As(err, &decodeErr) || len(decodeErr.Violations) != 1 {
+		t.Errorf("Expected missing required field to be reported, but got: %#v", err)
+	}
+}
+
+func TestInvalidMessageRejected(t *testing.T) {
+	validated, err := WithValidation(&typedBinding{rk: "#", en: "exchange/test"}, ValidationOptions{Schema: []byte(taskDefinedSchema)})
+	if err != nil {
+		t.Fatalf("Could not create validating binding: %v", err)
+	}
+	var reported []*DecodeError
+	sub := &subscription{
+		pulseQueue:    PulseQueue{bindings: newBindingSet(validated)},
+		onDecodeError: func(err *DecodeError) { reported = append(reported, err) },
+	}
+	ack := &recordingAcknowledger{}
+	if _, ok := sub.decode(amqp.Delivery{Acknowledger: ack, DeliveryTag: 3, Exchange: "exchange/test", Body: []byte(`{"taskId": 7}`)}); ok {
+		t.Errorf("Expected invalid message not to be dispatched")
+	}
+	if len(reported) != 1 || len(ack.rejects) != 1 || ack.rejects[0] != 3 || ack.requeued[0] {
+		t.Errorf("Expected invalid message to be reported and rejected without requeue, but got %v reports and %#v", len(reported), ack)
+	}
+	payload, ok := sub.decode(amqp.Delivery{Acknowledger: ack, DeliveryTag: 4, Exchange: "exchange/test", Body: []byte(`{"taskId": "abc"}`)})
+	if !ok || payload.(*taskDefined).TaskID != "abc" {
+		t.Errorf("Expected valid message to be dispatched, but got %#v", payload)
+	}
+}